@@ -0,0 +1,87 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+// Package flight shares an in-progress call, e.g. a request to IAM, between every caller that needs its result,
+// so that concurrent callers result in a single call.  A caller that gives up stops waiting, the call is only
+// cancelled once every caller waiting on it has given up.
+package flight
+
+import (
+	"context"
+	"sync"
+)
+
+// Flight is an in-progress call.  The owner of a Flight keeps it, guarded by the lock passed to Start, while
+// the call is in progress so that callers can Join it.
+type Flight struct {
+	mu     sync.Locker
+	done   chan struct{}
+	val    interface{}
+	err    error
+	cancel context.CancelFunc
+	// waiters is the number of callers waiting on done, guarded by mu
+	waiters int
+}
+
+// Start runs fn with ctx in a goroutine, cancel must release the resources associated with ctx.  When fn
+// returns, finish is called with fn's result and with mu, the owner's lock, held.  finish stores the result in
+// the owner's state and detaches f, what it returns is the result every waiter gets.  Start must be called
+// with mu held.
+func Start(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	mu sync.Locker,
+	fn func(ctx context.Context) (interface{}, error),
+	finish func(f *Flight, val interface{}, err error) (interface{}, error),
+) *Flight {
+	f := &Flight{
+		mu:     mu,
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer cancel()
+
+		val, err := fn(ctx)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		f.val, f.err = finish(f, val, err)
+		close(f.done)
+	}()
+
+	return f
+}
+
+// Join adds the caller to the waiters of f, it must be called with the lock passed to Start held and be
+// followed by Wait once the lock is released
+func (f *Flight) Join() {
+	f.waiters++
+}
+
+// Wait waits for the result of f.  If ctx is done first the caller stops waiting and ctx.Err() is returned, if
+// it was the last waiter detach is called with the lock passed to Start held, so that the next caller starts
+// a new Flight rather than picking up the cancellation error, and the call is cancelled.
+func (f *Flight) Wait(ctx context.Context, detach func()) (interface{}, error) {
+	select {
+	case <-f.done:
+		return f.val, f.err
+	case <-ctx.Done():
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		f.waiters--
+		if f.waiters == 0 {
+			detach()
+			f.cancel()
+		}
+
+		return nil, ctx.Err()
+	}
+}
+
+// Cancel cancels the call regardless of its waiters, e.g. when the owner is closed
+func (f *Flight) Cancel() {
+	f.cancel()
+}
@@ -0,0 +1,141 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package flight
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// owner holds a Flight the way the users of this package do
+type owner struct {
+	mu     sync.Mutex
+	flight *Flight
+	calls  int
+}
+
+func (o *owner) do(ctx context.Context, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	o.mu.Lock()
+	f := o.flight
+	if f == nil {
+		o.calls++
+		ctx, cancel := context.WithCancel(context.Background())
+		f = Start(ctx, cancel, &o.mu, fn, func(f *Flight, val interface{}, err error) (interface{}, error) {
+			if o.flight == f {
+				o.flight = nil
+			}
+
+			return val, err
+		})
+		o.flight = f
+	}
+	f.Join()
+	o.mu.Unlock()
+
+	return f.Wait(ctx, func() {
+		if o.flight == f {
+			o.flight = nil
+		}
+	})
+}
+
+func TestFlightShared(t *testing.T) {
+	t.Parallel()
+
+	o := &owner{}
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-release
+
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			val, err := o.do(context.Background(), fn)
+			assert.NoError(t, err)
+			results[i] = val
+		}(i)
+	}
+
+	// Wait for every caller to join before releasing the call
+	require.Eventually(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+
+		return o.flight != nil && o.flight.waiters == len(results)
+	}, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, 1, o.calls)
+	for _, val := range results {
+		assert.Equal(t, "value", val)
+	}
+}
+
+func TestFlightCancelledOnceEveryWaiterGivesUp(t *testing.T) {
+	t.Parallel()
+
+	o := &owner{}
+	cancelled := make(chan struct{})
+	fn := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		close(cancelled)
+
+		return nil, ctx.Err()
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() {
+		_, err := o.do(ctx1, fn)
+		errs <- err
+	}()
+	go func() {
+		_, err := o.do(ctx2, fn)
+		errs <- err
+	}()
+
+	require.Eventually(t, func() bool {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+
+		return o.flight != nil && o.flight.waiters == 2
+	}, time.Second, time.Millisecond)
+
+	// The call continues while one caller is still waiting
+	cancel1()
+	assert.Equal(t, context.Canceled, <-errs)
+	select {
+	case <-cancelled:
+		t.Fatal("call cancelled while a caller was still waiting")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel2()
+	assert.Equal(t, context.Canceled, <-errs)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("call not cancelled once every caller gave up")
+	}
+
+	// The next caller starts a new call rather than picking up the cancellation error
+	val, err := o.do(context.Background(), func(ctx context.Context) (interface{}, error) {
+		return "value", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "value", val)
+	assert.Equal(t, 2, o.calls)
+}
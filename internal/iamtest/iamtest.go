@@ -0,0 +1,60 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+// Package iamtest has helpers for the local fakes of IAM used in tests
+package iamtest
+
+import (
+	"net/url"
+	"sync"
+)
+
+// Recorder records the parameters of the requests made to a fake IAM endpoint, it is safe for concurrent use.
+// It is embedded in the fakes so that tests can check the requests made.
+type Recorder struct {
+	mu       sync.Mutex
+	requests []url.Values
+}
+
+// Record records the parameters of a request, e.g. its form
+func (r *Recorder) Record(params url.Values) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests = append(r.requests, params)
+}
+
+// Requests returns the parameters of each request recorded so far
+func (r *Recorder) Requests() []url.Values {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]url.Values(nil), r.requests...)
+}
+
+// Values returns the value of key in each request recorded so far, e.g. the grant_type of each token request
+func (r *Recorder) Values(key string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	values := make([]string, 0, len(r.requests))
+	for _, params := range r.requests {
+		values = append(values, params.Get(key))
+	}
+
+	return values
+}
+
+// Count returns the number of requests recorded so far whose key has value
+func (r *Recorder) Count(key, value string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, params := range r.requests {
+		if params.Get(key) == value {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,94 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+// Package filelock provides advisory locks on files that are shared between processes, e.g. the
+// terraform provider processes started by parallel terraform runs.  Locks are held per open file,
+// so goroutines in the same process that open the file separately also exclude each other.
+package filelock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pollInterval is how often LockPathContext tries to take a lock that is held
+const pollInterval = 20 * time.Millisecond
+
+// ErrLocked is returned by TryLockPath if the lock is held by someone else
+var ErrLocked = errors.New("file is locked")
+
+// Lock places an exclusive lock on f, blocking until it is available
+func Lock(f *os.File) error {
+	return lock(f, true, true)
+}
+
+// RLock places a shared lock on f, blocking until it is available
+func RLock(f *os.File) error {
+	return lock(f, false, true)
+}
+
+// Unlock releases the lock on f
+func Unlock(f *os.File) error {
+	return unlock(f)
+}
+
+// LockPath creates, if needed, and exclusively locks the lock file at path.  The returned function
+// releases the lock and closes the file.
+func LockPath(path string) (func() error, error) {
+	return lockPath(path, true, true)
+}
+
+// RLockPath creates, if needed, and places a shared lock on the lock file at path.  The returned
+// function releases the lock and closes the file.
+func RLockPath(path string) (func() error, error) {
+	return lockPath(path, false, true)
+}
+
+// TryLockPath is LockPath without blocking, ErrLocked is returned if the lock is held by someone else
+func TryLockPath(path string) (func() error, error) {
+	return lockPath(path, true, false)
+}
+
+// LockPathContext is LockPath that gives up when ctx is done, returning ctx.Err().  The lock is tried every
+// pollInterval while it is held by someone else.
+func LockPathContext(ctx context.Context, path string) (func() error, error) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		unlock, err := TryLockPath(path)
+		if !errors.Is(err, ErrLocked) {
+			return unlock, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func lockPath(path string, exclusive, block bool) (func() error, error) {
+	f, err := os.OpenFile(filepath.Clean(path), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = lock(f, exclusive, block); err != nil {
+		_ = f.Close()
+
+		return nil, err
+	}
+
+	return func() error {
+		err := unlock(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+
+		return err
+	}, nil
+}
@@ -0,0 +1,143 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package filelock
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockPathExclusive(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	var holders, maxHolders int32
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := LockPath(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			n := atomic.AddInt32(&holders, 1)
+			if n > atomic.LoadInt32(&maxHolders) {
+				atomic.StoreInt32(&maxHolders, n)
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+
+			assert.NoError(t, unlock())
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), maxHolders)
+}
+
+func TestRLockPathShared(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	unlock1, err := RLockPath(path)
+	require.NoError(t, err)
+	// A second shared lock is granted while the first is held
+	unlock2, err := RLockPath(path)
+	require.NoError(t, err)
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := LockPath(path)
+		if assert.NoError(t, err) {
+			close(locked)
+			assert.NoError(t, unlock())
+		}
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("exclusive lock granted while shared locks are held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, unlock1())
+	assert.NoError(t, unlock2())
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("exclusive lock not granted once shared locks were released")
+	}
+}
+
+func TestLockUnlock(t *testing.T) {
+	t.Parallel()
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.lock"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	assert.NoError(t, Lock(f))
+	assert.NoError(t, Unlock(f))
+	assert.NoError(t, RLock(f))
+	assert.NoError(t, Unlock(f))
+}
+
+func TestTryLockPath(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	unlock, err := TryLockPath(path)
+	require.NoError(t, err)
+
+	// The lock is held, so a second attempt fails without blocking
+	_, err = TryLockPath(path)
+	assert.True(t, errors.Is(err, ErrLocked))
+
+	assert.NoError(t, unlock())
+	unlock, err = TryLockPath(path)
+	require.NoError(t, err)
+	assert.NoError(t, unlock())
+}
+
+func TestLockPathContext(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "test.lock")
+
+	unlock, err := LockPath(path)
+	require.NoError(t, err)
+
+	// Waiting for a held lock stops when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = LockPathContext(ctx, path)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// The lock is taken once it is released
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := LockPathContext(context.Background(), path)
+		if assert.NoError(t, err) {
+			close(locked)
+			assert.NoError(t, unlock())
+		}
+	}()
+	time.Sleep(2 * pollInterval)
+	assert.NoError(t, unlock())
+
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock not taken once it was released")
+	}
+}
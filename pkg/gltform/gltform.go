@@ -3,109 +3,530 @@
 package gltform
 
 import (
-	"io"
+	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/filelock"
 )
 
-const fileExtension = ".gltform"
+const (
+	fileExtension = ".gltform"
+
+	// DefaultProfile the profile used if there is no current_profile, and the only profile of a file in the
+	// flat format
+	DefaultProfile = "default"
+
+	// ProfileEnv the env-var that selects the profile read by GetGLConfig, overriding current_profile
+	ProfileEnv = "HPEGL_GLTFORM_PROFILE"
+)
 
-// Gljwt - the contents of the .gltform file
+// Gljwt - the metal config, and the service-client credentials, in the .gltform file or in a profile in it.
+// The metal fields are stored in the metal Section of the profile.
 type Gljwt struct {
 	// SpaceName is optional, and is only required for metal if we want to create a project
-	SpaceName string `yaml:"space_name,omitempty"`
+	SpaceName string
 	// ProjectID - the metal/Quake project ID
-	ProjectID string `yaml:"project_id"`
+	ProjectID string
 	// RestURL - the URL to be used for metal, at present it refers to a Quake portal URL
-	RestURL string `yaml:"rest_url"`
-	// TODO remove this entry once we've switched quake-client over to using this package
-	// Token - the GL IAM token
-	Token string `yaml:"access_token,omitempty"`
+	RestURL string
+	// TenantID, UserID and UserSecret are optional service-client credentials, see credentials.GLTFormProvider.
+	// UserSecret is only read, it isn't written by WriteGLConfig.
+	TenantID   string
+	UserID     string
+	UserSecret string
+	// Extra holds any other entries of the metal Section, e.g. other fields written by WriteGLConfig
+	Extra map[string]interface{}
+}
+
+// glProfile - a profile in the .gltform file, or the whole file in the flat format.  Services holds a
+// Section for each service, keyed by the name of the service's registration.ServiceRegistration.
+type glProfile struct {
+	TenantID   string             `yaml:"tenant_id,omitempty"`
+	UserID     string             `yaml:"user_id,omitempty"`
+	UserSecret string             `yaml:"user_secret,omitempty"`
+	Services   map[string]Section `yaml:"services,omitempty"`
+}
+
+// isZero returns true if p has no entries
+func (p *glProfile) isZero() bool {
+	return p.TenantID == "" && p.UserID == "" && p.UserSecret == "" && len(p.Services) == 0
+}
+
+// clone returns a copy of p that doesn't share its Sections
+func (p *glProfile) clone() *glProfile {
+	copied := *p
+	if p.Services != nil {
+		copied.Services = make(map[string]Section, len(p.Services))
+		for name, section := range p.Services {
+			copied.Services[name] = section.clone()
+		}
+	}
+
+	return &copied
+}
+
+// section returns the Section for service, for update.  It is created if it doesn't exist.
+func (p *glProfile) section(service string) Section {
+	if p.Services == nil {
+		p.Services = make(map[string]Section)
+	}
+
+	section, ok := p.Services[service]
+	if !ok || section == nil {
+		section = make(Section)
+		p.Services[service] = section
+	}
+
+	return section
+}
+
+// gljwt returns the metal Section and the credentials of p as a Gljwt
+func (p *glProfile) gljwt() (*Gljwt, error) {
+	gljwt := &Gljwt{TenantID: p.TenantID, UserID: p.UserID, UserSecret: p.UserSecret}
+
+	validationErr := &ValidationError{}
+	metal := p.Services[MetalService]
+	for _, k := range metal.keys() {
+		v := metal[k]
+		var err error
+		switch k {
+		case "space_name":
+			gljwt.SpaceName, err = stringValue(v)
+		case "project_id":
+			gljwt.ProjectID, err = stringValue(v)
+		case "rest_url":
+			gljwt.RestURL, err = stringValue(v)
+		default:
+			if gljwt.Extra == nil {
+				gljwt.Extra = make(map[string]interface{})
+			}
+			gljwt.Extra[k] = v
+		}
+		if err != nil {
+			validationErr.Errors = append(validationErr.Errors, &FieldError{Key: k, Err: err})
+		}
+	}
+
+	if len(validationErr.Errors) > 0 {
+		return nil, fmt.Errorf("%s section: %w", MetalService, validationErr)
+	}
+
+	return gljwt, nil
+}
+
+// setGljwt sets the entries of p from a config written by WriteGLConfig.  The credentials and extra fields
+// are only set if they are in from, so that the existing ones are kept.  The user_secret is never set, see
+// ParseGLConfig.
+func (p *glProfile) setGljwt(from *Gljwt) {
+	if from.TenantID != "" {
+		p.TenantID = from.TenantID
+	}
+	if from.UserID != "" {
+		p.UserID = from.UserID
+	}
+
+	metal := p.section(MetalService)
+	// If space_name isn't present, we'll just leave it out
+	if from.SpaceName != "" {
+		metal.SetString("space_name", from.SpaceName)
+	} else {
+		delete(metal, "space_name")
+	}
+	metal.SetString("project_id", from.ProjectID)
+	metal.SetString("rest_url", from.RestURL)
+	for k, v := range from.Extra {
+		metal[k] = v
+	}
+}
+
+// glFile - the .gltform file.  In the flat format the file holds a single glProfile, in the profile format it
+// holds named profiles and the name of the current profile.  Version is the version of the format, see
+// CurrentVersion.
+type glFile struct {
+	Version        int `yaml:"version"`
+	glProfile      `yaml:",inline"`
+	CurrentProfile string                `yaml:"current_profile,omitempty"`
+	Profiles       map[string]*glProfile `yaml:"profiles,omitempty"`
+}
+
+// flatFile - the flat format of the .gltform file
+type flatFile struct {
+	Version   int `yaml:"version"`
+	glProfile `yaml:",inline"`
+}
+
+// profileFile - the profile format of the .gltform file, used to write the file without the flat fields
+type profileFile struct {
+	Version        int                   `yaml:"version"`
+	CurrentProfile string                `yaml:"current_profile,omitempty"`
+	Profiles       map[string]*glProfile `yaml:"profiles"`
 }
 
-// GetGLConfig - reads the .gltform file, note that the .gltform can be in the home directory of the
-// user running terraform, or in the directory from which terraform is run
+// GetGLConfig - reads the .gltform file, the first file found in the SearchPath is used.  If the file has
+// profiles the profile named by the HPEGL_GLTFORM_PROFILE env-var, or else the current_profile, is returned.
+// If no file can be read a *SearchError describing every location tried is returned.
 func GetGLConfig() (gljwt *Gljwt, err error) {
-	homeDir, _ := os.UserHomeDir()
-	workingDir, _ := os.Getwd()
-	for _, p := range []string{workingDir, homeDir} {
-		gljwt, err = loadGLConfig(p)
+	return GetGLConfigProfile("")
+}
+
+// GetGLConfigProfile - reads the profile called name from the .gltform file, see GetGLConfig.  If name is
+// empty the current profile is returned.  A file in the flat format only has the DefaultProfile.
+func GetGLConfigProfile(name string) (*Gljwt, error) {
+	profile, err := searchGLProfile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return profile.gljwt()
+}
+
+// LoadGLConfigFile - reads the profile called name from the .gltform file at path, which needn't be called
+// .gltform.  If name is empty the current profile is returned.
+func LoadGLConfigFile(path, name string) (*Gljwt, error) {
+	return loadGLConfigProfile(filepath.Clean(path), name)
+}
+
+// searchGLProfile reads the profile called name, or the current profile if name is empty, from the first
+// .gltform file in the SearchPath that has it
+func searchGLProfile(name string) (*glProfile, error) {
+	paths, searchErr := searchPath()
+	for _, path := range paths {
+		profile, err := loadGLProfile(path, name)
 		if err == nil {
-			break
+			log.Printf("[DEBUG] using %s", path)
+
+			return profile, nil
 		}
+		if !os.IsNotExist(err) {
+			log.Printf("[WARN] skipping %s", err)
+		}
+		searchErr.Tried = append(searchErr.Tried, &LocationError{Path: path, Err: err})
 	}
 
-	return gljwt, err
+	return nil, searchErr
 }
 
 // WriteGLConfig takes a map[string]interface{} which will normally come from a
-// service block in the provider stanza and writes out a .gltform file in the directory
-// from which terraform is being run.  See the use of this function
-// for metal in terraform-provider-hpegl.
+// service block in the provider stanza and writes out a .gltform file at the WritePath, by default
+// in the directory from which terraform is being run.  See the use of this function
+// for metal in terraform-provider-hpegl.  d is validated by ParseGLConfig, if it is invalid a
+// *ValidationError is returned and nothing is written.  If d has a "profile" entry that profile is
+// written, otherwise the current profile is.  Other profiles, and the credentials and extra fields of
+// the profile that aren't in d, are kept.  A file in the flat format stays in the flat format unless
+// another profile is written, its contents then become the DefaultProfile.
 func WriteGLConfig(d map[string]interface{}) error {
-	config := &Gljwt{
-		// If space_name isn't present, we'll just write out ""
-		SpaceName: d["space_name"].(string),
-		ProjectID: d["project_id"].(string),
-		RestURL:   d["rest_url"].(string),
+	profile, _ := d["profile"].(string)
+
+	return WriteGLConfigProfile(profile, d)
+}
+
+// WriteGLConfigProfile writes the profile called name to the .gltform file, see WriteGLConfig.  If name is
+// empty the current profile is written.  If the file has no current_profile the profile becomes the current one.
+func WriteGLConfigProfile(name string, d map[string]interface{}) error {
+	path, err := WritePath()
+	if err != nil {
+		return err
 	}
 
-	// Marshal config
-	b, err := yaml.Marshal(config)
+	return WriteGLConfigFile(path, name, d)
+}
+
+// WriteGLConfigFile writes the profile called name to the .gltform file at path, which needn't be called
+// .gltform, see WriteGLConfigProfile
+func WriteGLConfigFile(path, name string, d map[string]interface{}) error {
+	gljwt, err := ParseGLConfig(d)
 	if err != nil {
 		return err
 	}
 
-	// Write out marshalled config into .gltform
-	workingDir, _ := os.Getwd()
+	return updateGLConfig(filepath.Clean(path), func(f *glFile) error {
+		f.profile(name).setGljwt(gljwt)
 
-	for _, p := range []string{workingDir} {
-		err = writeGLConfigToFile(b, p)
-		if err != nil {
-			break
+		return nil
+	})
+}
+
+// SetGLConfigCurrentProfile sets the current_profile of the .gltform file at the WritePath, the profile must exist
+func SetGLConfigCurrentProfile(name string) error {
+	path, err := WritePath()
+	if err != nil {
+		return err
+	}
+
+	return setGLConfigCurrentProfile(path, name)
+}
+
+func setGLConfigCurrentProfile(path, name string) error {
+	return updateGLConfig(path, func(f *glFile) error {
+		if _, ok := f.Profiles[name]; !ok {
+			if name != DefaultProfile || len(f.Profiles) > 0 {
+				return fmt.Errorf("profile %s not found in %s", name, path)
+			}
+			// Convert a flat file, its contents become the DefaultProfile
+			f.profile(DefaultProfile)
 		}
+		f.CurrentProfile = name
+
+		return nil
+	})
+}
+
+// currentProfileName returns the name of the profile used if none is specified
+func (f *glFile) currentProfileName() string {
+	if name := os.Getenv(ProfileEnv); name != "" {
+		return name
+	}
+	if f.CurrentProfile != "" {
+		return f.CurrentProfile
 	}
 
-	return err
+	return DefaultProfile
 }
 
-func writeGLConfigToFile(b []byte, dir string) error {
-	f, err := os.Create(filepath.Clean(filepath.Join(dir, fileExtension)))
+// lookup returns the profile called name, or the current profile if name is empty
+func (f *glFile) lookup(name string) (*glProfile, bool) {
+	if name == "" {
+		name = f.currentProfileName()
+	}
+
+	if len(f.Profiles) == 0 {
+		if name != DefaultProfile {
+			return nil, false
+		}
+
+		return f.glProfile.clone(), true
+	}
+
+	profile, ok := f.Profiles[name]
+	if !ok || profile == nil {
+		return nil, false
+	}
+
+	return profile.clone(), true
+}
+
+// profile returns the profile called name, or the current profile if name is empty, for update.  It is created
+// if it doesn't exist, converting a flat file to the profile format if need be.
+func (f *glFile) profile(name string) *glProfile {
+	if name == "" {
+		name = f.currentProfileName()
+	}
+
+	if len(f.Profiles) == 0 {
+		if name == DefaultProfile && f.CurrentProfile == "" {
+			return &f.glProfile
+		}
+		f.Profiles = make(map[string]*glProfile)
+		if !f.glProfile.isZero() {
+			// The contents of the flat file become the DefaultProfile, which stays the current profile
+			flat := f.glProfile
+			f.Profiles[DefaultProfile] = &flat
+			if f.CurrentProfile == "" {
+				f.CurrentProfile = DefaultProfile
+			}
+			f.glProfile = glProfile{}
+		}
+	}
+
+	profile, ok := f.Profiles[name]
+	if !ok || profile == nil {
+		profile = &glProfile{}
+		f.Profiles[name] = profile
+	}
+
+	if f.CurrentProfile == "" {
+		f.CurrentProfile = name
+	}
+
+	return profile
+}
+
+// marshal marshals the file in the flat format if it has no profiles, and in the profile format otherwise.
+// The file is always written in the CurrentVersion.
+func (f *glFile) marshal() ([]byte, error) {
+	if len(f.Profiles) == 0 {
+		return yaml.Marshal(&flatFile{Version: CurrentVersion, glProfile: f.glProfile})
+	}
+
+	return yaml.Marshal(&profileFile{Version: CurrentVersion, CurrentProfile: f.CurrentProfile, Profiles: f.Profiles})
+}
+
+// updateGLConfig reads the .gltform file at path, if there is one, applies update to it and writes it out
+// with the lock on the file held throughout
+func updateGLConfig(path string, update func(f *glFile) error) error {
+	unlock, err := filelock.LockPath(lockFilePath(path))
 	if err != nil {
 		return err
 	}
+	defer unlock() // nolint errcheck
 
-	defer f.Close()
+	f := &glFile{}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		if f, _, err = parseGLFile(b); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
 
-	_, err = f.Write(b)
+	if err = update(f); err != nil {
+		return err
+	}
+
+	b, err = f.marshal()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(b, path)
+}
+
+// writeFileAtomic writes b to the .gltform file at path.  It is written to a temporary file that is then
+// renamed, so that readers never see a partially written file.  The lock on the file must be held.
+func writeFileAtomic(b []byte, path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(f.Name()) // nolint errcheck
+
+	if err = f.Chmod(0600); err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	if _, err = f.Write(b); err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+
+		return err
+	}
 
-	return f.Sync()
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
 }
 
-func loadGLConfig(dir string) (*Gljwt, error) {
-	f, err := os.Open(filepath.Clean(filepath.Join(dir, fileExtension)))
+// loadGLConfigProfile reads the profile called name, or the current profile if name is empty, from the
+// .gltform file at path
+func loadGLConfigProfile(path, name string) (*Gljwt, error) {
+	profile, err := loadGLProfile(path, name)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	return parseGLStream(f)
+	gljwt, err := profile.gljwt()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return gljwt, nil
 }
 
-func parseGLStream(s io.Reader) (*Gljwt, error) {
-	contents, err := ioutil.ReadAll(s)
+// loadGLProfile reads the profile called name, or the current profile if name is empty, from the .gltform
+// file at path
+func loadGLProfile(path, name string) (*glProfile, error) {
+	f, err := loadGLFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	q := &Gljwt{}
-	err = yaml.Unmarshal(contents, q)
+	profile, ok := f.lookup(name)
+	if !ok {
+		if name == "" {
+			name = f.currentProfileName()
+		}
+
+		return nil, fmt.Errorf("profile %s not found in %s", name, path)
+	}
+
+	return profile, nil
+}
+
+// loadGLFile reads the .gltform file at path.  A file in an older version is upgraded in place, e.g. so that
+// a stored access_token is removed, if it can't be, e.g. because its directory is read-only, the upgraded
+// contents are used anyway.
+func loadGLFile(path string) (*glFile, error) {
+	f, version, err := readGLFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if version < CurrentVersion {
+		// The file is read again with the exclusive lock held, in case it has changed
+		log.Printf("[INFO] upgrading %s from version %d to version %d", path, version, CurrentVersion)
+		if err = updateGLConfig(path, func(*glFile) error { return nil }); err != nil {
+			log.Printf("[WARN] failed to upgrade %s: %s", path, err)
+		}
+	}
+
+	return f, nil
+}
+
+// readGLFile reads the .gltform file at path with a shared lock on the file held, returning the version of
+// the file as well as its upgraded contents.  If the lock can't be taken, e.g. because the directory is
+// read-only, the file is read anyway since it is always replaced atomically.
+func readGLFile(path string) (*glFile, int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, 0, err
+	}
+
+	unlock, err := filelock.RLockPath(lockFilePath(path))
+	if err != nil {
+		log.Printf("[DEBUG] reading %s without a lock: %s", path, err)
+	} else {
+		defer unlock() // nolint errcheck
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, version, err := parseGLFile(b)
+	if err != nil {
+		return nil, version, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return f, version, nil
+}
+
+// lockFilePath returns the path of the lock file for the .gltform file at path
+func lockFilePath(path string) string {
+	return path + ".lock"
+}
+
+// parseGLFile parses a .gltform file in either format and any supported version, see decodeGLFile.  If a
+// file in the profile format also has flat entries they are the DefaultProfile, unless there is a profile
+// of that name.
+func parseGLFile(contents []byte) (*glFile, int, error) {
+	f, version, err := decodeGLFile(contents)
+	if err != nil {
+		return nil, version, err
+	}
+
+	if len(f.Profiles) > 0 && !f.glProfile.isZero() {
+		if _, ok := f.Profiles[DefaultProfile]; !ok {
+			flat := f.glProfile
+			f.Profiles[DefaultProfile] = &flat
+		}
+		f.glProfile = glProfile{}
+	}
 
-	return q, err
+	return f, version, nil
 }
@@ -0,0 +1,470 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package gltform
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// helperEnv is set when the test binary is run as a subprocess by TestGLConfigConcurrentProcesses
+	helperEnv = "GLTFORM_TEST_HELPER"
+	// writesPerWriter is the number of times each writer writes the .gltform file
+	writesPerWriter = 20
+)
+
+// versionLine is the first line of a .gltform file written in the CurrentVersion
+var versionLine = fmt.Sprintf("version: %d\n", CurrentVersion)
+
+// gltformPath returns the path of the .gltform file in dir
+func gltformPath(dir string) string {
+	return filepath.Join(dir, fileExtension)
+}
+
+// testConfig returns a config whose fields can be checked for consistency with each other
+func testConfig(writer string, n int) map[string]interface{} {
+	return map[string]interface{}{
+		"space_name": "space",
+		"project_id": fmt.Sprintf("%s-%d", writer, n),
+		"rest_url":   fmt.Sprintf("https://client.greenlake.hpe.com/%s-%d", writer, n),
+	}
+}
+
+func writeTestConfig(dir string, d map[string]interface{}) error {
+	return WriteGLConfigFile(gltformPath(dir), "", d)
+}
+
+// checkConfig checks that a config read from the .gltform file wasn't truncated or interleaved with another write
+func checkConfig(t *testing.T, gljwt *Gljwt) {
+	t.Helper()
+	assert.Equal(t, "space", gljwt.SpaceName)
+	assert.NotEmpty(t, gljwt.ProjectID)
+	assert.True(t, strings.HasSuffix(gljwt.RestURL, "/"+gljwt.ProjectID), "mismatched config %+v", gljwt)
+}
+
+// checkDir checks the permissions of the .gltform file in dir, and that no temporary files are left behind
+func checkDir(t *testing.T, dir string) {
+	t.Helper()
+	checkFile(t, gltformPath(dir))
+}
+
+// checkFile checks the permissions of the .gltform file at path, and that no temporary files are left behind
+func checkFile(t *testing.T, path string) {
+	t.Helper()
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	files, err := filepath.Glob(path + ".tmp*")
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestWriteLoadGLConfig(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	require.NoError(t, writeTestConfig(dir, testConfig("writer", 1)))
+	gljwt, err := LoadGLConfigFile(gltformPath(dir), "")
+	require.NoError(t, err)
+	assert.Equal(t, &Gljwt{
+		SpaceName: "space",
+		ProjectID: "writer-1",
+		RestURL:   "https://client.greenlake.hpe.com/writer-1",
+	}, gljwt)
+
+	// A shorter config replaces the file completely
+	require.NoError(t, writeTestConfig(dir, metalConfig("p")))
+	gljwt, err = LoadGLConfigFile(gltformPath(dir), "")
+	require.NoError(t, err)
+	assert.Equal(t, &Gljwt{ProjectID: "p", RestURL: "https://client.greenlake.hpe.com/p"}, gljwt)
+
+	checkDir(t, dir)
+}
+
+func TestLoadGLConfigMissing(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	_, err := LoadGLConfigFile(gltformPath(dir), "")
+	assert.True(t, os.IsNotExist(err))
+
+	// No lock file is created in a directory without a .gltform file
+	_, err = os.Stat(lockFilePath(gltformPath(dir)))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGLConfigConcurrentGoroutines(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	require.NoError(t, writeTestConfig(dir, testConfig("initial", 0)))
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		writer := fmt.Sprintf("writer%d", w)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < writesPerWriter; n++ {
+				assert.NoError(t, writeTestConfig(dir, testConfig(writer, n)))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for n := 0; n < writesPerWriter; n++ {
+				gljwt, err := LoadGLConfigFile(gltformPath(dir), "")
+				if assert.NoError(t, err) {
+					checkConfig(t, gljwt)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	checkDir(t, dir)
+}
+
+// TestGLConfigHelperProcess isn't a real test, it is run as a subprocess by TestGLConfigConcurrentProcesses
+// to write and read the .gltform file in its working directory
+func TestGLConfigHelperProcess(t *testing.T) {
+	writer := os.Getenv(helperEnv)
+	if writer == "" {
+		t.Skip("only run as a subprocess")
+	}
+
+	for n := 0; n < writesPerWriter; n++ {
+		require.NoError(t, WriteGLConfig(testConfig(writer, n)))
+
+		gljwt, err := GetGLConfig()
+		require.NoError(t, err)
+		checkConfig(t, gljwt)
+	}
+}
+
+func TestGLConfigConcurrentProcesses(t *testing.T) {
+	t.Parallel()
+	if os.Getenv(helperEnv) != "" {
+		t.Skip("already running as a subprocess")
+	}
+	dir := t.TempDir()
+
+	cmds := make([]*exec.Cmd, 4)
+	for i := range cmds {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestGLConfigHelperProcess$", "-test.count=1")
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), helperEnv+"=process"+strconv.Itoa(i))
+		require.NoError(t, cmd.Start())
+		cmds[i] = cmd
+	}
+
+	// Read the file while the subprocesses are writing it
+	for n := 0; n < writesPerWriter; n++ {
+		gljwt, err := LoadGLConfigFile(gltformPath(dir), "")
+		if os.IsNotExist(err) {
+			continue
+		}
+		if assert.NoError(t, err) {
+			checkConfig(t, gljwt)
+		}
+	}
+
+	for i, cmd := range cmds {
+		assert.NoError(t, cmd.Wait(), "subprocess %d failed", i)
+	}
+
+	checkDir(t, dir)
+}
+
+func metalConfig(projectID string) map[string]interface{} {
+	return map[string]interface{}{
+		"space_name": "",
+		"project_id": projectID,
+		"rest_url":   "https://client.greenlake.hpe.com/" + projectID,
+	}
+}
+
+func readFile(t *testing.T, dir string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join(dir, fileExtension))
+	require.NoError(t, err)
+
+	return string(b)
+}
+
+func TestGLConfigFlatFormat(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fileExtension),
+		[]byte("project_id: p1\nrest_url: u1\nuser_id: id\n"), 0600))
+
+	for _, name := range []string{"", DefaultProfile} {
+		gljwt, err := LoadGLConfigFile(gltformPath(dir), name)
+		require.NoError(t, err)
+		assert.Equal(t, &Gljwt{ProjectID: "p1", RestURL: "u1", UserID: "id"}, gljwt)
+	}
+
+	_, err := LoadGLConfigFile(gltformPath(dir), "prod")
+	assert.EqualError(t, err, "profile prod not found in "+filepath.Join(dir, fileExtension))
+
+	// Writing the current profile keeps the flat format, and the entries that aren't written
+	require.NoError(t, WriteGLConfigFile(gltformPath(dir), "", metalConfig("p2")))
+	assert.Equal(t, versionLine+`user_id: id
+services:
+  metal:
+    project_id: p2
+    rest_url: https://client.greenlake.hpe.com/p2
+`, readFile(t, dir))
+}
+
+func TestGLConfigProfiles(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	require.NoError(t, WriteGLConfigFile(gltformPath(dir), "", metalConfig("p1")))
+
+	// Writing another profile converts the file, the flat contents become the current default profile
+	require.NoError(t, WriteGLConfigFile(gltformPath(dir), "prod", metalConfig("prod1")))
+	assert.Equal(t, versionLine+`current_profile: default
+profiles:
+  default:
+    services:
+      metal:
+        project_id: p1
+        rest_url: https://client.greenlake.hpe.com/p1
+  prod:
+    services:
+      metal:
+        project_id: prod1
+        rest_url: https://client.greenlake.hpe.com/prod1
+`, readFile(t, dir))
+
+	gljwt, err := LoadGLConfigFile(gltformPath(dir), "")
+	require.NoError(t, err)
+	assert.Equal(t, "p1", gljwt.ProjectID)
+	gljwt, err = LoadGLConfigFile(gltformPath(dir), "prod")
+	require.NoError(t, err)
+	assert.Equal(t, "prod1", gljwt.ProjectID)
+
+	require.NoError(t, setGLConfigCurrentProfile(gltformPath(dir), "prod"))
+	gljwt, err = LoadGLConfigFile(gltformPath(dir), "")
+	require.NoError(t, err)
+	assert.Equal(t, "prod1", gljwt.ProjectID)
+
+	// Writing the current profile updates prod
+	require.NoError(t, WriteGLConfigFile(gltformPath(dir), "", metalConfig("prod2")))
+	gljwt, err = LoadGLConfigFile(gltformPath(dir), "prod")
+	require.NoError(t, err)
+	assert.Equal(t, "prod2", gljwt.ProjectID)
+	gljwt, err = LoadGLConfigFile(gltformPath(dir), DefaultProfile)
+	require.NoError(t, err)
+	assert.Equal(t, "p1", gljwt.ProjectID)
+
+	assert.EqualError(t, setGLConfigCurrentProfile(gltformPath(dir), "staging"),
+		"profile staging not found in "+filepath.Join(dir, fileExtension))
+}
+
+func TestGLConfigNewProfileFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	// A named profile written to a new file becomes the current profile
+	require.NoError(t, WriteGLConfigFile(gltformPath(dir), "dev", metalConfig("dev1")))
+	assert.Equal(t, versionLine+`current_profile: dev
+profiles:
+  dev:
+    services:
+      metal:
+        project_id: dev1
+        rest_url: https://client.greenlake.hpe.com/dev1
+`, readFile(t, dir))
+
+	gljwt, err := LoadGLConfigFile(gltformPath(dir), "")
+	require.NoError(t, err)
+	assert.Equal(t, "dev1", gljwt.ProjectID)
+}
+
+func TestGLConfigMixedFormat(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fileExtension), []byte(`project_id: flat
+rest_url: flat-url
+current_profile: prod
+profiles:
+  prod:
+    project_id: prod1
+    rest_url: prod-url
+`), 0600))
+
+	gljwt, err := LoadGLConfigFile(gltformPath(dir), "")
+	require.NoError(t, err)
+	assert.Equal(t, "prod1", gljwt.ProjectID)
+
+	// The flat entries are the default profile
+	gljwt, err = LoadGLConfigFile(gltformPath(dir), DefaultProfile)
+	require.NoError(t, err)
+	assert.Equal(t, &Gljwt{ProjectID: "flat", RestURL: "flat-url"}, gljwt)
+}
+
+// TestGLConfigProfileEnv isn't run in parallel since it sets the ProfileEnv env-var
+func TestGLConfigProfileEnv(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, WriteGLConfigFile(gltformPath(dir), "dev", metalConfig("dev1")))
+	require.NoError(t, WriteGLConfigFile(gltformPath(dir), "prod", metalConfig("prod1")))
+
+	require.NoError(t, os.Setenv(ProfileEnv, "prod"))
+	defer os.Unsetenv(ProfileEnv)
+
+	gljwt, err := LoadGLConfigFile(gltformPath(dir), "")
+	require.NoError(t, err)
+	assert.Equal(t, "prod1", gljwt.ProjectID)
+}
+
+// update rewrites the golden files in testdata, run "go test ./pkg/gltform -update" after changing the format
+var update = flag.Bool("update", false, "update the .golden files in testdata")
+
+// copyTestdata copies the testdata file name.gltform to a .gltform file in a new directory
+func copyTestdata(t *testing.T, name string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name+fileExtension))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fileExtension), b, 0600))
+
+	return dir
+}
+
+func TestGLConfigMigrations(t *testing.T) {
+	t.Parallel()
+	testcases := []struct {
+		name string
+		want *Gljwt
+	}{
+		{
+			name: "v0_flat",
+			want: &Gljwt{SpaceName: "space", ProjectID: "project", RestURL: "https://client.greenlake.hpe.com/api/metal"},
+		},
+		{
+			name: "v0_profiles",
+			want: &Gljwt{SpaceName: "prod-space", ProjectID: "prod-project", RestURL: "https://client.greenlake.hpe.com/api/metal"},
+		},
+		{
+			name: "v0_mixed",
+			want: &Gljwt{ProjectID: "flat-project", RestURL: "https://flat.example.com/api/metal"},
+		},
+		{
+			name: "v1_flat",
+			want: &Gljwt{ProjectID: "project", RestURL: "https://client.greenlake.hpe.com/api/metal", TenantID: "tenant"},
+		},
+		{
+			name: "v1_profiles",
+			want: &Gljwt{ProjectID: "dev-project", RestURL: "https://dev.example.com/api/metal"},
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := copyTestdata(t, tc.name)
+
+			gljwt, err := LoadGLConfigFile(gltformPath(dir), "")
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, gljwt)
+
+			// The file has been upgraded in place
+			golden := filepath.Join("testdata", tc.name+".golden")
+			if *update {
+				require.NoError(t, ioutil.WriteFile(golden, []byte(readFile(t, dir)), 0600))
+			}
+			want, err := ioutil.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(want), readFile(t, dir))
+
+			// Reading the upgraded file gives the same config
+			gljwt, err = LoadGLConfigFile(gltformPath(dir), "")
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, gljwt)
+		})
+	}
+}
+
+// TestGLConfigStripsAccessToken isn't run in parallel since it changes the working directory
+func TestGLConfigStripsAccessToken(t *testing.T) {
+	dir := copyTestdata(t, "v0_flat")
+	require.Contains(t, readFile(t, dir), "access_token")
+	defer searchEnv(t, dir, map[string]string{"HOME": tempDir(t)})()
+
+	gljwt, err := GetGLConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "project", gljwt.ProjectID)
+
+	// The stored access_token is removed from the file on disk by the read
+	assert.NotContains(t, readFile(t, dir), "access_token")
+	assert.True(t, strings.HasPrefix(readFile(t, dir), versionLine))
+	checkDir(t, dir)
+}
+
+func TestGLConfigDecodeErrors(t *testing.T) {
+	t.Parallel()
+	testcases := []struct {
+		name   string
+		errMsg string
+	}{
+		{
+			name:   "unknown_key",
+			errMsg: "field colour not found",
+		},
+		{
+			name:   "unknown_profile_key",
+			errMsg: "field region not found",
+		},
+		{
+			name:   "v1_access_token",
+			errMsg: "field access_token not found",
+		},
+		{
+			name:   "v1_extra",
+			errMsg: "field extra not found",
+		},
+		{
+			name:   "v1_services",
+			errMsg: "services isn't allowed before version 2",
+		},
+		{
+			name:   "future_version",
+			errMsg: fmt.Sprintf("unsupported version 99, the latest supported version is %d", CurrentVersion),
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := copyTestdata(t, tc.name)
+			before := readFile(t, dir)
+
+			_, err := LoadGLConfigFile(gltformPath(dir), "")
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), filepath.Join(dir, fileExtension))
+			assert.Contains(t, err.Error(), tc.errMsg)
+
+			// The file is left alone, and can't be written to
+			assert.Error(t, WriteGLConfigFile(gltformPath(dir), "", metalConfig("p1")))
+			assert.Equal(t, before, readFile(t, dir))
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package gltform
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CurrentVersion is the version of the .gltform format written by this package.  Files without a version
+// entry are version 0, the flat or profile format in which a stored access_token is allowed.  Version 1
+// adds the version entry, access_token is no longer allowed.  Version 2 adds a Section for each service, the
+// metal entries move to the metal Section.
+const CurrentVersion = 2
+
+// migration upgrades the raw contents of a .gltform file from version from to version from+1
+type migration struct {
+	from    int
+	migrate func(raw map[interface{}]interface{}) error
+}
+
+// migrations are applied in order to upgrade a file to CurrentVersion, there is one for each version
+// before CurrentVersion
+var migrations = []migration{
+	{from: 0, migrate: stripAccessToken},
+	{from: 1, migrate: moveMetalToSection},
+}
+
+// metalKeys the entries of a profile that are moved to its metal Section in version 2
+var metalKeys = []string{"space_name", "project_id", "rest_url"}
+
+// migrate upgrades the raw contents of a .gltform file to CurrentVersion, returning the version of the file
+// before it was upgraded.  Files from a later version are rejected.
+func migrate(raw map[interface{}]interface{}) (int, error) {
+	version := 0
+	if v, ok := raw["version"]; ok {
+		if version, ok = v.(int); !ok {
+			return 0, fmt.Errorf("version %v is not an integer", v)
+		}
+	}
+
+	if version < 0 || version > CurrentVersion {
+		return version, fmt.Errorf("unsupported version %d, the latest supported version is %d", version, CurrentVersion)
+	}
+
+	for _, m := range migrations {
+		if m.from < version {
+			continue
+		}
+		if err := m.migrate(raw); err != nil {
+			return version, fmt.Errorf("upgrading from version %d: %w", m.from, err)
+		}
+	}
+	raw["version"] = CurrentVersion
+
+	return version, nil
+}
+
+// stripAccessToken removes the access_token stored by old tooling, from the top-level of the file and
+// from each profile.  Tokens are no longer shared through the .gltform file.
+func stripAccessToken(raw map[interface{}]interface{}) error {
+	return forEachProfile(raw, func(profile map[interface{}]interface{}) error {
+		delete(profile, "access_token")
+
+		return nil
+	})
+}
+
+// moveMetalToSection moves the metal entries of the top-level of the file and of each profile to a metal
+// Section
+func moveMetalToSection(raw map[interface{}]interface{}) error {
+	return forEachProfile(raw, func(profile map[interface{}]interface{}) error {
+		if _, ok := profile["services"]; ok {
+			return errors.New("services isn't allowed before version 2")
+		}
+
+		metal := make(map[interface{}]interface{})
+		for _, k := range metalKeys {
+			if v, ok := profile[k]; ok {
+				// Empty entries were written for a missing space_name, and for a profile without metal config
+				if v != nil && v != "" {
+					metal[k] = v
+				}
+				delete(profile, k)
+			}
+		}
+
+		if len(metal) > 0 {
+			profile["services"] = map[interface{}]interface{}{MetalService: metal}
+		}
+
+		return nil
+	})
+}
+
+// forEachProfile applies fn to the top-level of the file, which holds the flat format entries, and to each
+// profile
+func forEachProfile(raw map[interface{}]interface{}, fn func(profile map[interface{}]interface{}) error) error {
+	if err := fn(raw); err != nil {
+		return err
+	}
+
+	profiles, ok := raw["profiles"].(map[interface{}]interface{})
+	if !ok {
+		return nil
+	}
+
+	for name, p := range profiles {
+		if p == nil {
+			continue
+		}
+		profile, ok := p.(map[interface{}]interface{})
+		if !ok {
+			return fmt.Errorf("profile %v is not a map", name)
+		}
+		if err := fn(profile); err != nil {
+			return fmt.Errorf("profile %v: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// decodeGLFile decodes the contents of a .gltform file in any supported version, upgrading it to
+// CurrentVersion.  Unknown entries are reported as errors.  It returns the version of the file before
+// it was upgraded.
+func decodeGLFile(contents []byte) (*glFile, int, error) {
+	raw := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal(contents, &raw); err != nil {
+		return nil, 0, err
+	}
+
+	version, err := migrate(raw)
+	if err != nil {
+		return nil, version, err
+	}
+
+	b, err := yaml.Marshal(raw)
+	if err != nil {
+		return nil, version, err
+	}
+
+	f := &glFile{}
+	if err = yaml.UnmarshalStrict(b, f); err != nil {
+		return nil, version, err
+	}
+
+	return f, version, nil
+}
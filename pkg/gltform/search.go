@@ -0,0 +1,191 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package gltform
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	// PathEnv the env-var holding a list of .gltform files, or directories containing one, separated by
+	// os.PathListSeparator.  They are searched before the default locations, and the first is written to.
+	PathEnv = "HPEGL_GLTFORM_PATH"
+
+	// configDirName the directory under the XDG config directories that is searched
+	configDirName = "hpegl"
+
+	// repoRootMarker marks the root of a repo, parent directories of the working directory are searched
+	// up to the repo root
+	repoRootMarker = ".git"
+)
+
+// LocationError a location that was tried when searching for the .gltform file, and why it wasn't used
+type LocationError struct {
+	// Path is the path of the .gltform file, or a description of the location if its path isn't known
+	Path string
+	Err  error
+}
+
+func (e *LocationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+func (e *LocationError) Unwrap() error {
+	return e.Err
+}
+
+// SearchError is returned when no .gltform file can be read, it describes every location tried
+type SearchError struct {
+	Tried []*LocationError
+}
+
+func (e *SearchError) Error() string {
+	var b strings.Builder
+	b.WriteString("no usable .gltform file found, tried:")
+	for _, t := range e.Tried {
+		b.WriteString("\n  ")
+		b.WriteString(t.Error())
+	}
+
+	return b.String()
+}
+
+// Is reports whether every location tried failed with target, e.g. errors.Is(err, os.ErrNotExist) is
+// true if no .gltform file was found at all
+func (e *SearchError) Is(target error) bool {
+	if len(e.Tried) == 0 {
+		return false
+	}
+
+	for _, t := range e.Tried {
+		if !errors.Is(t.Err, target) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SearchPath returns the paths searched for the .gltform file, in order:
+//   - the entries of HPEGL_GLTFORM_PATH, a directory entry is searched for a .gltform file
+//   - the working directory, and if it is in a repo its parent directories up to the repo root
+//   - hpegl/.gltform in $XDG_CONFIG_HOME, by default ~/.config
+//   - the home directory
+//   - hpegl/.gltform in each of $XDG_CONFIG_DIRS, by default /etc/xdg
+//
+// Locations that can't be determined, e.g. if there is no home directory, are left out.
+func SearchPath() []string {
+	paths, _ := searchPath()
+
+	return paths
+}
+
+// WritePath returns the path the .gltform file is written to, the first entry of HPEGL_GLTFORM_PATH if it
+// is set, or else the working directory
+func WritePath() (string, error) {
+	if entries := pathEnvEntries(); len(entries) > 0 {
+		return entries[0], nil
+	}
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("finding the working directory: %w", err)
+	}
+
+	return filepath.Join(workingDir, fileExtension), nil
+}
+
+// searchPath returns the SearchPath, and a SearchError holding any locations that couldn't be determined
+func searchPath() ([]string, *SearchError) {
+	searchErr := &SearchError{}
+	paths := pathEnvEntries()
+
+	if workingDir, err := os.Getwd(); err != nil {
+		searchErr.Tried = append(searchErr.Tried, &LocationError{Path: "working directory", Err: err})
+	} else {
+		for _, dir := range repoDirs(workingDir) {
+			paths = append(paths, filepath.Join(dir, fileExtension))
+		}
+	}
+
+	homeDir, homeErr := os.UserHomeDir()
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" && homeErr == nil {
+		configHome = filepath.Join(homeDir, ".config")
+	}
+	if configHome != "" {
+		paths = append(paths, filepath.Join(configHome, configDirName, fileExtension))
+	}
+
+	if homeErr != nil {
+		searchErr.Tried = append(searchErr.Tried, &LocationError{Path: "home directory", Err: homeErr})
+	} else {
+		paths = append(paths, filepath.Join(homeDir, fileExtension))
+	}
+
+	configDirs := os.Getenv("XDG_CONFIG_DIRS")
+	if configDirs == "" && runtime.GOOS != "windows" {
+		configDirs = "/etc/xdg"
+	}
+	for _, dir := range filepath.SplitList(configDirs) {
+		if dir != "" {
+			paths = append(paths, filepath.Join(dir, configDirName, fileExtension))
+		}
+	}
+
+	return dedupe(paths), searchErr
+}
+
+// pathEnvEntries returns the paths of the .gltform files listed in HPEGL_GLTFORM_PATH
+func pathEnvEntries() []string {
+	var paths []string
+	for _, entry := range filepath.SplitList(os.Getenv(PathEnv)) {
+		if entry == "" {
+			continue
+		}
+		if info, err := os.Stat(entry); err == nil && info.IsDir() {
+			entry = filepath.Join(entry, fileExtension)
+		}
+		paths = append(paths, filepath.Clean(entry))
+	}
+
+	return paths
+}
+
+// repoDirs returns dir and, if dir is in a repo, its parent directories up to the repo root.  If dir
+// isn't in a repo only dir is returned.
+func repoDirs(dir string) []string {
+	dirs := []string{dir}
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, repoRootMarker)); err == nil {
+			return dirs
+		}
+
+		parent := filepath.Dir(d)
+		if parent == d {
+			return dirs[:1]
+		}
+		d = parent
+		dirs = append(dirs, d)
+	}
+}
+
+// dedupe removes repeated paths, keeping the first
+func dedupe(paths []string) []string {
+	seen := make(map[string]bool, len(paths))
+	deduped := paths[:0]
+	for _, p := range paths {
+		if !seen[p] {
+			seen[p] = true
+			deduped = append(deduped, p)
+		}
+	}
+
+	return deduped
+}
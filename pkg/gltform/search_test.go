@@ -0,0 +1,325 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package gltform
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// searchEnv sets up an isolated environment for searching for the .gltform file: the working directory is
+// changed to dir, and HPEGL_GLTFORM_PATH, HOME and the XDG env-vars are set from env.  The returned function
+// restores the environment.  Tests that use it can't be run in parallel.
+func searchEnv(t *testing.T, dir string, env map[string]string) func() {
+	t.Helper()
+	workingDir, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+
+	saved := make(map[string]*string)
+	for _, key := range []string{PathEnv, "HOME", "USERPROFILE", "XDG_CONFIG_HOME", "XDG_CONFIG_DIRS"} {
+		if value, ok := os.LookupEnv(key); ok {
+			saved[key] = &value
+		} else {
+			saved[key] = nil
+		}
+		require.NoError(t, os.Setenv(key, env[key]))
+	}
+	if home, ok := env["HOME"]; ok {
+		require.NoError(t, os.Setenv("USERPROFILE", home))
+	}
+
+	return func() {
+		for key, value := range saved {
+			if value == nil {
+				_ = os.Unsetenv(key)
+			} else {
+				_ = os.Setenv(key, *value)
+			}
+		}
+		_ = os.Chdir(workingDir)
+	}
+}
+
+// tempDir returns a new temporary directory with any symlinks resolved, so that paths under it match the
+// working directory when it is changed to one of them, e.g. on macOS
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+
+	return dir
+}
+
+// mkdirs creates the directories in root, and returns the path of the last one
+func mkdirs(t *testing.T, root string, dirs ...string) string {
+	t.Helper()
+	path := root
+	for _, d := range dirs {
+		path = filepath.Join(root, d)
+		require.NoError(t, os.MkdirAll(path, 0700))
+	}
+
+	return path
+}
+
+func TestRepoDirs(t *testing.T) {
+	t.Parallel()
+	root := tempDir(t)
+	nested := mkdirs(t, root, "repo/.git", "repo/envs/prod")
+	repo := filepath.Join(root, "repo")
+	outside := mkdirs(t, root, "outside/dir")
+
+	assert.Equal(t, []string{nested, filepath.Dir(nested), repo}, repoDirs(nested))
+	assert.Equal(t, []string{repo}, repoDirs(repo))
+	assert.Equal(t, []string{outside}, repoDirs(outside))
+}
+
+func TestSearchPath(t *testing.T) {
+	root := tempDir(t)
+	mkdirs(t, root, "repo/.git", "repo/envs/prod", "home", "explicit")
+	workingDir := filepath.Join(root, "repo", "envs", "prod")
+	home := filepath.Join(root, "home")
+	explicitDir := filepath.Join(root, "explicit")
+	explicitFile := filepath.Join(root, "explicit", "dev.gltform")
+
+	testcases := []struct {
+		name string
+		env  map[string]string
+		want []string
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"HOME": home},
+			want: []string{
+				filepath.Join(workingDir, fileExtension),
+				filepath.Join(root, "repo", "envs", fileExtension),
+				filepath.Join(root, "repo", fileExtension),
+				filepath.Join(home, ".config", configDirName, fileExtension),
+				filepath.Join(home, fileExtension),
+				filepath.Join("/etc/xdg", configDirName, fileExtension),
+			},
+		},
+		{
+			name: "path env and xdg dirs",
+			env: map[string]string{
+				"HOME":            home,
+				PathEnv:           explicitFile + string(os.PathListSeparator) + explicitDir,
+				"XDG_CONFIG_HOME": filepath.Join(root, "config"),
+				"XDG_CONFIG_DIRS": filepath.Join(root, "xdg1") + string(os.PathListSeparator) + filepath.Join(root, "xdg2"),
+			},
+			want: []string{
+				explicitFile,
+				filepath.Join(explicitDir, fileExtension),
+				filepath.Join(workingDir, fileExtension),
+				filepath.Join(root, "repo", "envs", fileExtension),
+				filepath.Join(root, "repo", fileExtension),
+				filepath.Join(root, "config", configDirName, fileExtension),
+				filepath.Join(home, fileExtension),
+				filepath.Join(root, "xdg1", configDirName, fileExtension),
+				filepath.Join(root, "xdg2", configDirName, fileExtension),
+			},
+		},
+		{
+			name: "repeated paths are searched once",
+			env: map[string]string{
+				"HOME":            home,
+				PathEnv:           filepath.Join(root, "repo"),
+				"XDG_CONFIG_DIRS": filepath.Join(root, "xdg1"),
+			},
+			want: []string{
+				filepath.Join(root, "repo", fileExtension),
+				filepath.Join(workingDir, fileExtension),
+				filepath.Join(root, "repo", "envs", fileExtension),
+				filepath.Join(home, ".config", configDirName, fileExtension),
+				filepath.Join(home, fileExtension),
+				filepath.Join(root, "xdg1", configDirName, fileExtension),
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			defer searchEnv(t, workingDir, tc.env)()
+			want := tc.want
+			if tc.env["XDG_CONFIG_DIRS"] == "" && runtime.GOOS == "windows" {
+				// /etc/xdg is only a default on unix
+				want = want[:len(want)-1]
+			}
+			assert.Equal(t, want, SearchPath())
+		})
+	}
+}
+
+func TestWritePath(t *testing.T) {
+	root := tempDir(t)
+	dir := mkdirs(t, root, "dir")
+	file := filepath.Join(root, "dev.gltform")
+
+	defer searchEnv(t, dir, map[string]string{PathEnv: file + string(os.PathListSeparator) + dir})()
+	path, err := WritePath()
+	require.NoError(t, err)
+	assert.Equal(t, file, path)
+
+	require.NoError(t, os.Setenv(PathEnv, dir))
+	path, err = WritePath()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, fileExtension), path)
+
+	require.NoError(t, os.Unsetenv(PathEnv))
+	path, err = WritePath()
+	require.NoError(t, err)
+	workingDir, err := os.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(workingDir, fileExtension), path)
+}
+
+func TestGetGLConfigSearch(t *testing.T) {
+	root := tempDir(t)
+	mkdirs(t, root, "repo/.git", "repo/envs/prod", "home/.config/hpegl", "xdg/hpegl", "explicit")
+	workingDir := filepath.Join(root, "repo", "envs", "prod")
+	home := filepath.Join(root, "home")
+	env := map[string]string{
+		"HOME":            home,
+		"XDG_CONFIG_DIRS": filepath.Join(root, "xdg"),
+	}
+
+	testcases := []struct {
+		name    string
+		files   map[string]string
+		pathEnv string
+		want    string
+	}{
+		{
+			name: "repo root",
+			files: map[string]string{
+				filepath.Join(root, "repo", fileExtension):      "repo",
+				filepath.Join(home, fileExtension):              "home",
+				filepath.Join(root, "xdg", "hpegl", ".gltform"): "xdg",
+			},
+			want: "repo",
+		},
+		{
+			name: "working directory before the repo root",
+			files: map[string]string{
+				filepath.Join(workingDir, fileExtension):   "prod",
+				filepath.Join(root, "repo", fileExtension): "repo",
+			},
+			want: "prod",
+		},
+		{
+			name: "xdg config home before the home directory",
+			files: map[string]string{
+				filepath.Join(home, ".config", "hpegl", fileExtension): "config",
+				filepath.Join(home, fileExtension):                     "home",
+			},
+			want: "config",
+		},
+		{
+			name: "xdg config dirs",
+			files: map[string]string{
+				filepath.Join(root, "xdg", "hpegl", fileExtension): "xdg",
+			},
+			want: "xdg",
+		},
+		{
+			name: "path env first",
+			files: map[string]string{
+				filepath.Join(root, "explicit", "dev.gltform"): "explicit",
+				filepath.Join(workingDir, fileExtension):       "prod",
+			},
+			pathEnv: filepath.Join(root, "explicit", "dev.gltform"),
+			want:    "explicit",
+		},
+		{
+			name: "invalid files are skipped",
+			files: map[string]string{
+				filepath.Join(workingDir, fileExtension): "",
+				filepath.Join(home, fileExtension):       "home",
+			},
+			want: "home",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			for path, projectID := range tc.files {
+				b := []byte("version: 1\nproject_id: " + projectID + "\nrest_url: https://example.com\n")
+				if projectID == "" {
+					b = []byte("unknown: key\n")
+				}
+				require.NoError(t, ioutil.WriteFile(path, b, 0600))
+			}
+			defer func() {
+				for path := range tc.files {
+					require.NoError(t, os.Remove(path))
+				}
+			}()
+
+			testEnv := map[string]string{PathEnv: tc.pathEnv}
+			for k, v := range env {
+				testEnv[k] = v
+			}
+			defer searchEnv(t, workingDir, testEnv)()
+
+			gljwt, err := GetGLConfig()
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, gljwt.ProjectID)
+		})
+	}
+}
+
+func TestGetGLConfigSearchError(t *testing.T) {
+	root := tempDir(t)
+	workingDir := mkdirs(t, root, "dir")
+	home := mkdirs(t, root, "home")
+	defer searchEnv(t, workingDir, map[string]string{
+		"HOME":            home,
+		"XDG_CONFIG_DIRS": filepath.Join(root, "xdg"),
+	})()
+
+	_, err := GetGLConfig()
+	require.Error(t, err)
+	var searchErr *SearchError
+	require.True(t, errors.As(err, &searchErr))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Len(t, searchErr.Tried, len(SearchPath()))
+	for _, path := range SearchPath() {
+		assert.Contains(t, err.Error(), "\n  "+path+": ")
+	}
+
+	// An invalid file is reported along with the missing ones
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, fileExtension), []byte("unknown: key\n"), 0600))
+	_, err = GetGLConfig()
+	require.Error(t, err)
+	assert.False(t, errors.Is(err, os.ErrNotExist))
+	assert.Contains(t, err.Error(), filepath.Join(home, fileExtension)+": "+filepath.Join(home, fileExtension)+
+		": yaml: unmarshal errors")
+}
+
+func TestGLConfigFileExplicitPath(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "prod.yaml")
+
+	require.NoError(t, WriteGLConfigFile(path, "", metalConfig("prod1")))
+	require.NoError(t, WriteGLConfigFile(path, "dev", metalConfig("dev1")))
+	checkFile(t, path)
+
+	gljwt, err := LoadGLConfigFile(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, "prod1", gljwt.ProjectID)
+
+	gljwt, err = LoadGLConfigFile(path, "dev")
+	require.NoError(t, err)
+	assert.Equal(t, "dev1", gljwt.ProjectID)
+
+	_, err = os.Stat(path + ".lock")
+	assert.NoError(t, err)
+}
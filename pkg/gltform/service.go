@@ -0,0 +1,381 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package gltform
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/client"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/registration"
+)
+
+// MetalService the name of the metal service, the Gljwt metal fields are stored in its Section
+const MetalService = "metal"
+
+// serviceCredentialKeys the entries of a service block declared by provider.ServiceCredentialsSchema, they
+// aren't written for the metal block since WriteGLConfig would make them the credentials of the profile
+var serviceCredentialKeys = []string{"iam_service_url", "tenant_id", "user_id", "user_secret"}
+
+// Section the entries stored for a service in a profile of the .gltform file, e.g. the settings of the
+// service's block in the provider stanza for use by out-of-band tooling.  Values are strings, numbers, bools,
+// or lists or maps of those.
+type Section map[string]interface{}
+
+// GetString returns the string at key, a missing key is an ErrMissingField and a value of another type an
+// ErrWrongType
+func (s Section) GetString(key string) (string, error) {
+	v, err := s.get(key)
+	if err != nil {
+		return "", err
+	}
+
+	str, err := stringValue(v)
+	if err != nil {
+		return "", &FieldError{Key: key, Err: err}
+	}
+
+	return str, nil
+}
+
+// GetBool returns the bool at key, see GetString
+func (s Section) GetBool(key string) (bool, error) {
+	v, err := s.get(key)
+	if err != nil {
+		return false, err
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, &FieldError{Key: key, Err: wrongType("a bool", v)}
+	}
+
+	return b, nil
+}
+
+// GetInt returns the integer at key, see GetString
+func (s Section) GetInt(key string) (int64, error) {
+	v, err := s.get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n := v.(type) {
+	case int:
+		return int64(n), nil
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	default:
+		return 0, &FieldError{Key: key, Err: wrongType("an integer", v)}
+	}
+}
+
+// GetFloat returns the number at key, which may be an integer, see GetString
+func (s Section) GetFloat(key string) (float64, error) {
+	v, err := s.get(key)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int32:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	default:
+		return 0, &FieldError{Key: key, Err: wrongType("a number", v)}
+	}
+}
+
+// GetStringList returns the list of strings at key, see GetString
+func (s Section) GetStringList(key string) ([]string, error) {
+	v, err := s.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, &FieldError{Key: key, Err: wrongType("a list", v)}
+	}
+
+	strs := make([]string, 0, len(l))
+	for i, elem := range l {
+		str, err := stringValue(elem)
+		if err != nil {
+			return nil, &FieldError{Key: key, Err: fmt.Errorf("element %d: %w", i, err)}
+		}
+		strs = append(strs, str)
+	}
+
+	return strs, nil
+}
+
+// SetString sets key to the string value
+func (s Section) SetString(key, value string) {
+	s[key] = value
+}
+
+// SetBool sets key to the bool value
+func (s Section) SetBool(key string, value bool) {
+	s[key] = value
+}
+
+// SetInt sets key to the integer value
+func (s Section) SetInt(key string, value int64) {
+	s[key] = value
+}
+
+// SetFloat sets key to the number value
+func (s Section) SetFloat(key string, value float64) {
+	s[key] = value
+}
+
+// SetStringList sets key to the list of strings value
+func (s Section) SetStringList(key string, value []string) {
+	l := make([]interface{}, 0, len(value))
+	for _, str := range value {
+		l = append(l, str)
+	}
+	s[key] = l
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.  yaml decodes nested maps with interface{} keys, they are converted
+// to string keys so that a Section that has been read can be validated and written back.
+func (s *Section) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var m map[string]interface{}
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+
+	for k, v := range m {
+		m[k] = stringKeys(v)
+	}
+	*s = m
+
+	return nil
+}
+
+// stringKeys returns v with the keys of any maps in it converted to strings
+func stringKeys(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, elem := range value {
+			m[fmt.Sprint(k)] = stringKeys(elem)
+		}
+
+		return m
+	case []interface{}:
+		l := make([]interface{}, 0, len(value))
+		for _, elem := range value {
+			l = append(l, stringKeys(elem))
+		}
+
+		return l
+	default:
+		return v
+	}
+}
+
+// get returns the value at key, a missing key is an ErrMissingField
+func (s Section) get(key string) (interface{}, error) {
+	v, ok := s[key]
+	if !ok || v == nil {
+		return nil, &FieldError{Key: key, Err: ErrMissingField}
+	}
+
+	return v, nil
+}
+
+// clone returns a copy of s, the values aren't copied
+func (s Section) clone() Section {
+	if s == nil {
+		return nil
+	}
+
+	copied := make(Section, len(s))
+	for k, v := range s {
+		copied[k] = v
+	}
+
+	return copied
+}
+
+// keys returns the keys of s in order
+func (s Section) keys() []string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// stringValue returns v if it is a string, and an ErrWrongType otherwise
+func stringValue(v interface{}) (string, error) {
+	str, ok := v.(string)
+	if !ok {
+		return "", wrongType("a string", v)
+	}
+
+	return str, nil
+}
+
+// wrongType returns an ErrWrongType for v, which was expected to be want
+func wrongType(want string, v interface{}) error {
+	return fmt.Errorf("%w: expected %s, got %T", ErrWrongType, want, v)
+}
+
+// GetServiceConfig reads the Section for service from the .gltform file, the first file found in the
+// SearchPath is used.  service is the name of the service's registration.ServiceRegistration.  The profile is
+// chosen as for GetGLConfig.  If the profile has no Section for service an empty Section is returned.
+func GetServiceConfig(service string) (Section, error) {
+	return GetServiceConfigProfile("", service)
+}
+
+// GetServiceConfigProfile reads the Section for service from the profile called name, see GetServiceConfig.
+// If name is empty the current profile is used.
+func GetServiceConfigProfile(name, service string) (Section, error) {
+	profile, err := searchGLProfile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return serviceSection(profile, service), nil
+}
+
+// LoadServiceConfigFile reads the Section for service from the profile called name of the .gltform file at
+// path, see GetServiceConfigProfile
+func LoadServiceConfigFile(path, name, service string) (Section, error) {
+	profile, err := loadGLProfile(filepath.Clean(path), name)
+	if err != nil {
+		return nil, err
+	}
+
+	return serviceSection(profile, service), nil
+}
+
+// WriteServiceConfig writes section to the Section for service in the current profile of the .gltform file
+// at the WritePath.  service is the name of the service's registration.ServiceRegistration.  The entries of
+// section are validated as for the extra fields of WriteGLConfig, if any is invalid a *ValidationError is
+// returned and nothing is written.  Entries already in the Section that aren't in section are kept, as are the
+// Sections of other services.
+func WriteServiceConfig(service string, section Section) error {
+	return WriteServiceConfigProfile("", service, section)
+}
+
+// WriteServiceConfigProfile writes section to the Section for service in the profile called name, see
+// WriteServiceConfig.  If name is empty the current profile is written.
+func WriteServiceConfigProfile(name, service string, section Section) error {
+	path, err := WritePath()
+	if err != nil {
+		return err
+	}
+
+	return WriteServiceConfigFile(path, name, service, section)
+}
+
+// WriteServiceConfigFile writes section to the Section for service in the profile called name of the .gltform
+// file at path, see WriteServiceConfigProfile
+func WriteServiceConfigFile(path, name, service string, section Section) error {
+	if service == "" {
+		return errors.New("no service name")
+	}
+
+	entries, fieldErrs := validateEntries(section, nil)
+	if len(fieldErrs) > 0 {
+		return &ValidationError{Errors: fieldErrs}
+	}
+
+	return updateGLConfig(filepath.Clean(path), func(f *glFile) error {
+		s := f.profile(name).section(service)
+		for k, v := range entries {
+			s[k] = v
+		}
+
+		return nil
+	})
+}
+
+// WriteServiceBlock writes the settings of the block for reg in the provider stanza r to reg's Section of the
+// current profile, see WriteServiceConfig.  Settings marked Sensitive in reg's ProviderSchemaEntry, e.g. a
+// user_secret, aren't written, and sets are written as lists.  The metal block is written with WriteGLConfig,
+// so that its settings are validated, without the service credentials of the block, which are only for the
+// metal token Handler.  It is an error if the block isn't in the provider stanza.
+func WriteServiceBlock(reg registration.ServiceRegistration, r *schema.ResourceData) error {
+	block, err := client.GetServiceSettingsMap(reg.Name(), r)
+	if err != nil {
+		return err
+	}
+
+	var sensitive map[string]bool
+	if entry := reg.ProviderSchemaEntry(); entry != nil {
+		sensitive = sensitiveSchemaFields(entry.Schema)
+	}
+
+	settings := make(map[string]interface{}, len(block))
+	for k, v := range block {
+		if !sensitive[k] {
+			settings[k] = setsToLists(v)
+		}
+	}
+
+	if reg.Name() == MetalService {
+		for _, k := range serviceCredentialKeys {
+			delete(settings, k)
+		}
+
+		return WriteGLConfig(settings)
+	}
+
+	return WriteServiceConfig(reg.Name(), settings)
+}
+
+// setsToLists returns v, a setting of a block in the provider stanza, with any *schema.Set in it converted to
+// a list
+func setsToLists(v interface{}) interface{} {
+	switch value := v.(type) {
+	case *schema.Set:
+		return setsToLists(value.List())
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, elem := range value {
+			m[k] = setsToLists(elem)
+		}
+
+		return m
+	case []interface{}:
+		l := make([]interface{}, 0, len(value))
+		for _, elem := range value {
+			l = append(l, setsToLists(elem))
+		}
+
+		return l
+	default:
+		return v
+	}
+}
+
+// serviceSection returns the Section for service in profile, or an empty Section
+func serviceSection(profile *glProfile, service string) Section {
+	section := profile.Services[service]
+	if section == nil {
+		section = make(Section)
+	}
+
+	return section
+}
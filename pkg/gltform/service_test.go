@@ -0,0 +1,303 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package gltform
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRegistration a registration.ServiceRegistration whose service block has a string, an int, a list, a set
+// and a sensitive string
+type testRegistration struct {
+	name string
+}
+
+func (r testRegistration) Name() string {
+	return r.name
+}
+
+func (r testRegistration) SupportedDataSources() map[string]*schema.Resource {
+	return nil
+}
+
+func (r testRegistration) SupportedResources() map[string]*schema.Resource {
+	return nil
+}
+
+func (r testRegistration) ProviderSchemaEntry() *schema.Resource {
+	return &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			"api_url":  {Type: schema.TypeString, Optional: true},
+			"replicas": {Type: schema.TypeInt, Optional: true},
+			"zones":    {Type: schema.TypeList, Optional: true, Elem: &schema.Schema{Type: schema.TypeString}},
+			"tags":     {Type: schema.TypeSet, Optional: true, Elem: &schema.Schema{Type: schema.TypeString}},
+			"secret":   {Type: schema.TypeString, Optional: true, Sensitive: true},
+		},
+	}
+}
+
+func TestSectionGetters(t *testing.T) {
+	t.Parallel()
+	s := Section{
+		"url":      "https://example.com",
+		"enabled":  true,
+		"replicas": 3,
+		"ratio":    0.5,
+		"zones":    []interface{}{"zone-a", "zone-b"},
+		"mixed":    []interface{}{"zone-a", 1},
+	}
+
+	str, err := s.GetString("url")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com", str)
+
+	b, err := s.GetBool("enabled")
+	assert.NoError(t, err)
+	assert.True(t, b)
+
+	n, err := s.GetInt("replicas")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	f, err := s.GetFloat("ratio")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.5, f)
+	f, err = s.GetFloat("replicas")
+	assert.NoError(t, err)
+	assert.Equal(t, float64(3), f)
+
+	l, err := s.GetStringList("zones")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"zone-a", "zone-b"}, l)
+
+	_, err = s.GetString("missing")
+	assert.True(t, errors.Is(err, ErrMissingField))
+	assert.EqualError(t, err, "missing: required field is missing")
+
+	_, err = s.GetInt("url")
+	assert.True(t, errors.Is(err, ErrWrongType))
+	assert.EqualError(t, err, "url: wrong type: expected an integer, got string")
+
+	_, err = s.GetBool("replicas")
+	assert.True(t, errors.Is(err, ErrWrongType))
+
+	_, err = s.GetStringList("mixed")
+	assert.EqualError(t, err, "mixed: element 1: wrong type: expected a string, got int")
+}
+
+func TestServiceConfigFile(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), fileExtension)
+	require.NoError(t, WriteGLConfigFile(path, "", metalConfig("p1")))
+
+	caas := Section{}
+	caas.SetString("api_url", "https://caas.example.com")
+	caas.SetBool("enabled", true)
+	caas.SetInt("replicas", 3)
+	caas.SetFloat("ratio", 0.5)
+	caas.SetStringList("zones", []string{"zone-a", "zone-b"})
+	require.NoError(t, WriteServiceConfigFile(path, "", "caas", caas))
+
+	// Each service has its own section, and the metal fields are in the metal section
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, versionLine+`services:
+  caas:
+    api_url: https://caas.example.com
+    enabled: true
+    ratio: 0.5
+    replicas: 3
+    zones:
+    - zone-a
+    - zone-b
+  metal:
+    project_id: p1
+    rest_url: https://client.greenlake.hpe.com/p1
+`, string(b))
+
+	section, err := LoadServiceConfigFile(path, "", "caas")
+	require.NoError(t, err)
+	n, err := section.GetInt("replicas")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	l, err := section.GetStringList("zones")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"zone-a", "zone-b"}, l)
+
+	section, err = LoadServiceConfigFile(path, "", MetalService)
+	require.NoError(t, err)
+	projectID, err := section.GetString("project_id")
+	require.NoError(t, err)
+	assert.Equal(t, "p1", projectID)
+
+	// A service without a section has an empty one
+	section, err = LoadServiceConfigFile(path, "", "vmaas")
+	require.NoError(t, err)
+	assert.Empty(t, section)
+
+	// Writing metal keeps the other sections, and writing a section keeps its entries that aren't written
+	require.NoError(t, WriteGLConfigFile(path, "", metalConfig("p2")))
+	require.NoError(t, WriteServiceConfigFile(path, "", "caas", Section{"api_url": "https://caas2.example.com"}))
+	section, err = LoadServiceConfigFile(path, "", "caas")
+	require.NoError(t, err)
+	assert.Equal(t, Section{
+		"api_url":  "https://caas2.example.com",
+		"enabled":  true,
+		"ratio":    0.5,
+		"replicas": 3,
+		"zones":    []interface{}{"zone-a", "zone-b"},
+	}, section)
+	gljwt, err := LoadGLConfigFile(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, "p2", gljwt.ProjectID)
+
+	// Sections are per profile
+	require.NoError(t, WriteServiceConfigFile(path, "prod", "caas", Section{"api_url": "https://prod.example.com"}))
+	section, err = LoadServiceConfigFile(path, "prod", "caas")
+	require.NoError(t, err)
+	assert.Equal(t, Section{"api_url": "https://prod.example.com"}, section)
+	section, err = LoadServiceConfigFile(path, DefaultProfile, "caas")
+	require.NoError(t, err)
+	assert.Equal(t, "https://caas2.example.com", section["api_url"])
+}
+
+func TestServiceConfigNestedMaps(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), fileExtension)
+	labels := map[string]interface{}{
+		"team":  "infra",
+		"owner": map[string]interface{}{"name": "ops", "ids": []interface{}{1, 2}},
+		"rules": []interface{}{map[string]interface{}{"allow": true}},
+	}
+
+	// A Section with nested maps can be written, read and written back
+	require.NoError(t, WriteServiceConfigFile(path, "", "caas", Section{"labels": labels}))
+	section, err := LoadServiceConfigFile(path, "", "caas")
+	require.NoError(t, err)
+	assert.Equal(t, Section{"labels": labels}, section)
+	require.NoError(t, WriteServiceConfigFile(path, "", "caas", section))
+
+	// As can the extra fields of the metal section
+	d := metalConfig("p1")
+	d["labels"] = labels
+	require.NoError(t, WriteGLConfigFile(path, "", d))
+	gljwt, err := LoadGLConfigFile(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, labels, gljwt.Extra["labels"])
+	d = metalConfig("p2")
+	for k, v := range gljwt.Extra {
+		d[k] = v
+	}
+	require.NoError(t, WriteGLConfigFile(path, "", d))
+
+	section, err = LoadServiceConfigFile(path, "", MetalService)
+	require.NoError(t, err)
+	assert.Equal(t, Section{
+		"labels":     labels,
+		"project_id": "p2",
+		"rest_url":   "https://client.greenlake.hpe.com/p2",
+	}, section)
+}
+
+func TestWriteServiceConfigValidation(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), fileExtension)
+
+	err := WriteServiceConfigFile(path, "", "caas", Section{"api_url": "https://caas.example.com", "hook": func() {}})
+	assert.True(t, errors.Is(err, ErrWrongType))
+	assert.EqualError(t, err, "invalid .gltform config: hook: wrong type: unsupported type func()")
+
+	assert.EqualError(t, WriteServiceConfigFile(path, "", "", Section{"api_url": "https://caas.example.com"}),
+		"no service name")
+
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestGLConfigMetalSectionWrongType(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), fileExtension)
+	require.NoError(t, ioutil.WriteFile(path, []byte(versionLine+`services:
+  metal:
+    project_id: 1
+    rest_url: https://client.greenlake.hpe.com/p1
+`), 0600))
+
+	_, err := LoadGLConfigFile(path, "")
+	assert.True(t, errors.Is(err, ErrWrongType))
+	assert.EqualError(t, err, path+": metal section: invalid .gltform config: project_id: wrong type: expected a "+
+		"string, got int")
+}
+
+func TestWriteServiceBlock(t *testing.T) {
+	root := tempDir(t)
+	path := filepath.Join(root, "dev.gltform")
+	defer searchEnv(t, mkdirs(t, root, "dir"), map[string]string{PathEnv: path, "HOME": root})()
+
+	caas := testRegistration{name: "caas"}
+	metal := testRegistration{name: MetalService}
+	d := schema.TestResourceDataRaw(t, map[string]*schema.Schema{
+		caas.Name(): {Type: schema.TypeSet, Optional: true, Elem: caas.ProviderSchemaEntry()},
+		metal.Name(): {Type: schema.TypeSet, Optional: true, Elem: &schema.Resource{Schema: map[string]*schema.Schema{
+			"project_id": {Type: schema.TypeString, Optional: true},
+			"rest_url":   {Type: schema.TypeString, Optional: true},
+			"space_name": {Type: schema.TypeString, Optional: true},
+			"tenant_id":  {Type: schema.TypeString, Optional: true},
+			"user_id":    {Type: schema.TypeString, Optional: true},
+		}}},
+		"vmaas": {Type: schema.TypeSet, Optional: true, Elem: caas.ProviderSchemaEntry()},
+	}, map[string]interface{}{
+		caas.Name(): []interface{}{map[string]interface{}{
+			"api_url":  "https://caas.example.com",
+			"replicas": 3,
+			"zones":    []interface{}{"zone-a"},
+			"tags":     []interface{}{"team-a"},
+			"secret":   "shh",
+		}},
+		metal.Name(): []interface{}{map[string]interface{}{
+			"project_id": "p1",
+			"rest_url":   "https://client.greenlake.hpe.com/p1",
+			"tenant_id":  "metal-tenant",
+			"user_id":    "metal-client",
+		}},
+	})
+
+	require.NoError(t, WriteServiceBlock(caas, d))
+	require.NoError(t, WriteServiceBlock(metal, d))
+	assert.EqualError(t, WriteServiceBlock(testRegistration{name: "vmaas"}, d),
+		"service vmaas block not defined in hpegl stanza")
+
+	section, err := GetServiceConfig(caas.Name())
+	require.NoError(t, err)
+	// The sensitive setting isn't written, and the set is written as a list
+	assert.Equal(t, Section{
+		"api_url":  "https://caas.example.com",
+		"replicas": 3,
+		"zones":    []interface{}{"zone-a"},
+		"tags":     []interface{}{"team-a"},
+	}, section)
+
+	// The service credentials of the metal block don't become the credentials of the profile
+	gljwt, err := GetGLConfig()
+	require.NoError(t, err)
+	assert.Equal(t, &Gljwt{ProjectID: "p1", RestURL: "https://client.greenlake.hpe.com/p1"}, gljwt)
+
+	// The metal block is validated
+	d = schema.TestResourceDataRaw(t, map[string]*schema.Schema{
+		metal.Name(): {Type: schema.TypeSet, Optional: true, Elem: &schema.Resource{Schema: map[string]*schema.Schema{
+			"project_id": {Type: schema.TypeString, Optional: true},
+			"rest_url":   {Type: schema.TypeString, Optional: true},
+		}}},
+	}, map[string]interface{}{
+		metal.Name(): []interface{}{map[string]interface{}{"project_id": "p2", "rest_url": "not a url"}},
+	})
+	assert.True(t, errors.Is(WriteServiceBlock(metal, d), ErrInvalidValue))
+}
@@ -0,0 +1,259 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package gltform
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+var (
+	// ErrMissingField a required field is missing from the config passed to WriteGLConfig
+	ErrMissingField = errors.New("required field is missing")
+	// ErrWrongType a field of the config passed to WriteGLConfig has the wrong type
+	ErrWrongType = errors.New("wrong type")
+	// ErrInvalidValue a field of the config passed to WriteGLConfig has an invalid value
+	ErrInvalidValue = errors.New("invalid value")
+
+	// projectIDPattern project ids, e.g. metal/Quake project UUIDs, are letters, digits, '.', '_' and '-'
+	projectIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+	// sensitiveFields are never written to the .gltform file, so that secrets aren't stored in plaintext
+	sensitiveFields = map[string]bool{
+		"user_secret": true,
+	}
+)
+
+// stringField a string field of the config passed to WriteGLConfig, and where it goes in a Gljwt
+type stringField struct {
+	key      string
+	required bool
+	validate func(s string) error
+	set      func(g *Gljwt, s string)
+}
+
+// stringFields are the fields of the config with entries in Gljwt, any other fields are extra fields.  The
+// profile field selects the profile written and isn't stored.
+var stringFields = []stringField{
+	{key: "profile"},
+	{key: "space_name", set: func(g *Gljwt, s string) { g.SpaceName = s }},
+	{key: "project_id", required: true, validate: validateProjectID, set: func(g *Gljwt, s string) { g.ProjectID = s }},
+	{key: "rest_url", required: true, validate: validateRestURL, set: func(g *Gljwt, s string) { g.RestURL = s }},
+	{key: "tenant_id", set: func(g *Gljwt, s string) { g.TenantID = s }},
+	{key: "user_id", set: func(g *Gljwt, s string) { g.UserID = s }},
+}
+
+// FieldError a problem with a field of the config passed to WriteGLConfig
+type FieldError struct {
+	Key string
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Key, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError is returned when the config passed to WriteGLConfig is invalid, it lists every problem
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fe.Error())
+	}
+
+	return "invalid .gltform config: " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether any of the problems is target, e.g. errors.Is(err, ErrMissingField)
+func (e *ValidationError) Is(target error) bool {
+	for _, fe := range e.Errors {
+		if errors.Is(fe, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseGLConfig validates d, which will normally come from a service block in the provider stanza, and
+// returns the Gljwt it describes.  project_id and rest_url are required, rest_url must be an absolute URL and
+// project_id may only contain letters, digits, '.', '_' and '-'.  space_name, tenant_id, user_id and profile
+// are optional strings.  Any other fields are returned in Extra, their values must be strings, numbers, bools,
+// or lists or maps of those.  A nil or empty value is treated as missing.  Sensitive fields, e.g. user_secret,
+// are left out so that they aren't written to the .gltform file.  If d is invalid a *ValidationError listing
+// every problem is returned.
+func ParseGLConfig(d map[string]interface{}) (*Gljwt, error) {
+	gljwt := &Gljwt{}
+	validationErr := &ValidationError{}
+	known := make(map[string]bool, len(stringFields))
+
+	for _, field := range stringFields {
+		known[field.key] = true
+		v := d[field.key]
+		if isEmpty(v) {
+			if field.required {
+				validationErr.Errors = append(validationErr.Errors, &FieldError{Key: field.key, Err: ErrMissingField})
+			}
+
+			continue
+		}
+
+		s, ok := v.(string)
+		if !ok {
+			validationErr.Errors = append(validationErr.Errors, &FieldError{
+				Key: field.key,
+				Err: fmt.Errorf("%w: expected a string, got %T", ErrWrongType, v),
+			})
+
+			continue
+		}
+
+		if field.validate != nil {
+			if err := field.validate(s); err != nil {
+				validationErr.Errors = append(validationErr.Errors, &FieldError{Key: field.key, Err: err})
+
+				continue
+			}
+		}
+
+		if field.set != nil {
+			field.set(gljwt, s)
+		}
+	}
+
+	extra, fieldErrs := validateEntries(d, known)
+	validationErr.Errors = append(validationErr.Errors, fieldErrs...)
+	if len(extra) > 0 {
+		gljwt.Extra = extra
+	}
+
+	if len(validationErr.Errors) > 0 {
+		return nil, validationErr
+	}
+
+	return gljwt, nil
+}
+
+// validateEntries checks the values of the entries of d whose keys aren't in skip, in key order.  It returns
+// the valid entries, and a FieldError for each invalid one.  Entries with nil or empty values, and sensitive
+// fields, are left out.
+func validateEntries(d map[string]interface{}, skip map[string]bool) (map[string]interface{}, []*FieldError) {
+	keys := make([]string, 0, len(d))
+	for k, v := range d {
+		if sensitiveFields[k] {
+			log.Printf("[DEBUG] not writing sensitive field %s to the .gltform file", k)
+
+			continue
+		}
+		if !skip[k] && !isEmpty(v) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	valid := make(map[string]interface{}, len(keys))
+	var fieldErrs []*FieldError
+	for _, k := range keys {
+		if err := validateExtra(d[k]); err != nil {
+			fieldErrs = append(fieldErrs, &FieldError{Key: k, Err: err})
+
+			continue
+		}
+		valid[k] = d[k]
+	}
+
+	return valid, fieldErrs
+}
+
+// isEmpty returns true for nil, empty strings and empty lists and maps, which aren't written to the .gltform file
+func isEmpty(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case []interface{}:
+		return len(value) == 0
+	case map[string]interface{}:
+		return len(value) == 0
+	default:
+		return false
+	}
+}
+
+// sensitiveSchemaFields returns the keys of the entries of schemas that are marked Sensitive
+func sensitiveSchemaFields(schemas ...map[string]*schema.Schema) map[string]bool {
+	fields := make(map[string]bool)
+	for _, s := range schemas {
+		for k, v := range s {
+			if v.Sensitive {
+				fields[k] = true
+			}
+		}
+	}
+
+	return fields
+}
+
+// validateProjectID checks the format of a project id
+func validateProjectID(s string) error {
+	if !projectIDPattern.MatchString(s) {
+		return fmt.Errorf("%w: %q may only contain letters, digits, '.', '_' and '-'", ErrInvalidValue, s)
+	}
+
+	return nil
+}
+
+// validateRestURL checks that s is an absolute URL
+func validateRestURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidValue, err)
+	}
+
+	if !u.IsAbs() || u.Host == "" {
+		return fmt.Errorf("%w: %q is not an absolute URL", ErrInvalidValue, s)
+	}
+
+	return nil
+}
+
+// validateExtra checks that the value of an extra field can be stored in the .gltform file and read back
+func validateExtra(v interface{}) error {
+	switch value := v.(type) {
+	case string, bool, int, int32, int64, float32, float64:
+		return nil
+	case []interface{}:
+		for i, elem := range value {
+			if err := validateExtra(elem); err != nil {
+				return fmt.Errorf("element %d: %w", i, err)
+			}
+		}
+
+		return nil
+	case map[string]interface{}:
+		for k, elem := range value {
+			if err := validateExtra(elem); err != nil {
+				return fmt.Errorf("entry %s: %w", k, err)
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("%w: unsupported type %T", ErrWrongType, v)
+	}
+}
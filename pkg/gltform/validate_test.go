@@ -0,0 +1,219 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package gltform
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGLConfig(t *testing.T) {
+	t.Parallel()
+	testcases := []struct {
+		name    string
+		d       map[string]interface{}
+		want    *Gljwt
+		wantErr error
+		errMsg  string
+	}{
+		{
+			name: "metal config",
+			d: map[string]interface{}{
+				"space_name": "space",
+				"project_id": "d2a2a9d7-6bc2-4a6e-9e3a-0f7b1c0e9c51",
+				"rest_url":   "https://client.greenlake.hpe.com/api/metal",
+			},
+			want: &Gljwt{
+				SpaceName: "space",
+				ProjectID: "d2a2a9d7-6bc2-4a6e-9e3a-0f7b1c0e9c51",
+				RestURL:   "https://client.greenlake.hpe.com/api/metal",
+			},
+		},
+		{
+			name: "missing and nil space_name",
+			d: map[string]interface{}{
+				"project_id": "p1",
+				"rest_url":   "https://example.com",
+				"user_id":    nil,
+			},
+			want: &Gljwt{ProjectID: "p1", RestURL: "https://example.com"},
+		},
+		{
+			name: "extra fields",
+			d: map[string]interface{}{
+				"profile":    "dev",
+				"project_id": "p1",
+				"rest_url":   "https://example.com",
+				"user_id":    "id",
+				"location":   "dev-location",
+				"replicas":   3,
+				"zones":      []interface{}{"zone-a", "zone-b"},
+				"labels":     map[string]interface{}{"team": "infra", "enabled": true},
+			},
+			want: &Gljwt{ProjectID: "p1", RestURL: "https://example.com", UserID: "id", Extra: map[string]interface{}{
+				"location": "dev-location",
+				"replicas": 3,
+				"zones":    []interface{}{"zone-a", "zone-b"},
+				"labels":   map[string]interface{}{"team": "infra", "enabled": true},
+			}},
+		},
+		{
+			name: "sensitive and empty fields",
+			d: map[string]interface{}{
+				"space_name":      "",
+				"project_id":      "p1",
+				"rest_url":        "https://example.com",
+				"user_secret":     "secret",
+				"iam_service_url": "",
+				"zones":           []interface{}{},
+			},
+			want: &Gljwt{ProjectID: "p1", RestURL: "https://example.com"},
+		},
+		{
+			name:    "empty required field",
+			d:       map[string]interface{}{"project_id": "", "rest_url": "https://example.com"},
+			wantErr: ErrMissingField,
+			errMsg:  "invalid .gltform config: project_id: required field is missing",
+		},
+		{
+			name:    "missing required fields",
+			d:       map[string]interface{}{"space_name": "space"},
+			wantErr: ErrMissingField,
+			errMsg:  "invalid .gltform config: project_id: required field is missing; rest_url: required field is missing",
+		},
+		{
+			name: "wrong type",
+			d: map[string]interface{}{
+				"space_name": 1,
+				"project_id": "p1",
+				"rest_url":   "https://example.com",
+			},
+			wantErr: ErrWrongType,
+			errMsg:  "space_name: wrong type: expected a string, got int",
+		},
+		{
+			name: "wrong profile type",
+			d: map[string]interface{}{
+				"profile":    true,
+				"project_id": "p1",
+				"rest_url":   "https://example.com",
+			},
+			wantErr: ErrWrongType,
+			errMsg:  "profile: wrong type: expected a string, got bool",
+		},
+		{
+			name: "relative rest_url",
+			d: map[string]interface{}{
+				"project_id": "p1",
+				"rest_url":   "client.greenlake.hpe.com/api/metal",
+			},
+			wantErr: ErrInvalidValue,
+			errMsg:  `rest_url: invalid value: "client.greenlake.hpe.com/api/metal" is not an absolute URL`,
+		},
+		{
+			name: "unparsable rest_url",
+			d: map[string]interface{}{
+				"project_id": "p1",
+				"rest_url":   "https://example.com/%zz",
+			},
+			wantErr: ErrInvalidValue,
+			errMsg:  "rest_url: invalid value: parse",
+		},
+		{
+			name: "invalid project_id",
+			d: map[string]interface{}{
+				"project_id": "my project",
+				"rest_url":   "https://example.com",
+			},
+			wantErr: ErrInvalidValue,
+			errMsg:  `project_id: invalid value: "my project" may only contain letters, digits, '.', '_' and '-'`,
+		},
+		{
+			name: "unsupported extra field",
+			d: map[string]interface{}{
+				"project_id": "p1",
+				"rest_url":   "https://example.com",
+				"zones":      []interface{}{"zone-a", struct{}{}},
+			},
+			wantErr: ErrWrongType,
+			errMsg:  "zones: element 1: wrong type: unsupported type struct {}",
+		},
+		{
+			name:    "every problem is reported",
+			d:       map[string]interface{}{"project_id": 1, "rest_url": "/api/metal", "callback": func() {}},
+			wantErr: ErrWrongType,
+			errMsg: "invalid .gltform config: project_id: wrong type: expected a string, got int; " +
+				`rest_url: invalid value: "/api/metal" is not an absolute URL; ` +
+				"callback: wrong type: unsupported type func()",
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			gljwt, err := ParseGLConfig(tc.d)
+			if tc.wantErr != nil {
+				require.Error(t, err)
+				var validationErr *ValidationError
+				assert.True(t, errors.As(err, &validationErr))
+				assert.True(t, errors.Is(err, tc.wantErr))
+				assert.Contains(t, err.Error(), tc.errMsg)
+				assert.Nil(t, gljwt)
+
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, gljwt)
+		})
+	}
+}
+
+func TestWriteGLConfigValidation(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+
+	// An invalid config isn't written, and doesn't panic
+	err := WriteGLConfigFile(gltformPath(dir), "", map[string]interface{}{"space_name": "space"})
+	assert.True(t, errors.Is(err, ErrMissingField))
+	_, err = os.Stat(gltformPath(dir))
+	assert.True(t, os.IsNotExist(err))
+
+	// Extra fields are written, and kept when the profile is rewritten without them.  The user_secret isn't
+	// written.
+	d := metalConfig("p1")
+	d["user_id"] = "id"
+	d["user_secret"] = "secret"
+	d["location"] = "dev-location"
+	d["replicas"] = 3
+	require.NoError(t, WriteGLConfigFile(gltformPath(dir), "", d))
+	require.NoError(t, WriteGLConfigFile(gltformPath(dir), "", metalConfig("p2")))
+	assert.Equal(t, versionLine+`user_id: id
+services:
+  metal:
+    location: dev-location
+    project_id: p2
+    replicas: 3
+    rest_url: https://client.greenlake.hpe.com/p2
+`, readFile(t, dir))
+
+	gljwt, err := LoadGLConfigFile(gltformPath(dir), "")
+	require.NoError(t, err)
+	assert.Equal(t, &Gljwt{
+		ProjectID: "p2",
+		RestURL:   "https://client.greenlake.hpe.com/p2",
+		UserID:    "id",
+		Extra:     map[string]interface{}{"location": "dev-location", "replicas": 3},
+	}, gljwt)
+
+	// An invalid config leaves the file alone
+	before := readFile(t, dir)
+	d = metalConfig("p3")
+	d["rest_url"] = "not a url"
+	assert.True(t, errors.Is(WriteGLConfigFile(gltformPath(dir), "", d), ErrInvalidValue))
+	assert.Equal(t, before, readFile(t, dir))
+}
@@ -86,6 +86,66 @@ func Schema() map[string]*schema.Schema {
             service clients use the appropriate GL "client" URL. Can be set by HPEGL_IAM_SERVICE_URL env-var`,
 	}
 
+	providerSchema["iam_token_verify"] = &schema.Schema{
+		Type:        schema.TypeBool,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_IAM_TOKEN_VERIFY", false),
+		Description: `Declare if the signature and claims of IAM tokens, including a passed-in token, are to be
+            verified against the JWKS of the issuer found using OIDC discovery from iam_service_url.  Defaults to
+            "false".  The value can be set using the HPEGL_IAM_TOKEN_VERIFY env-var.`,
+	}
+
+	providerSchema["iam_token_cache"] = &schema.Schema{
+		Type:        schema.TypeBool,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_IAM_TOKEN_CACHE", false),
+		Description: `Declare if service-client tokens are to be cached on disk, encrypted with the user_secret, so
+            that they are shared between terraform runs.  Not used with a passed-in token, or if there is no
+            user_secret.  Defaults to "false".  The value can be set using the HPEGL_IAM_TOKEN_CACHE env-var.`,
+	}
+
+	providerSchema["iam_token_cache_dir"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_IAM_TOKEN_CACHE_DIR", ""),
+		Description: `The directory the token cache is kept in, defaults to hpegl/token-cache in the user's config
+            directory.  Only used if iam_token_cache is "true".  Can be set by HPEGL_IAM_TOKEN_CACHE_DIR env-var`,
+	}
+
+	providerSchema["iam_jwks_file"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_IAM_JWKS_FILE", ""),
+		Description: `A local JWKS file used to verify IAM tokens instead of the issuer's JWKS, for air-gapped
+            testing.  Only used if iam_token_verify is "true".  Can be set by HPEGL_IAM_JWKS_FILE env-var`,
+	}
+
+	providerSchema["iam_verify_audience"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_IAM_VERIFY_AUDIENCE", ""),
+		Description: `The audience that IAM tokens must have been issued for, the audience isn't checked if this
+            isn't set.  Only used if iam_token_verify is "true".  Can be set by HPEGL_IAM_VERIFY_AUDIENCE env-var`,
+	}
+
+	providerSchema["iam_scopes"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_IAM_SCOPES", "hpe-tenant"),
+		Description: `The space or comma separated OAuth scopes asked for when generating tokens for API-vended
+            service clients.  Defaults to "hpe-tenant".  Services may ask for different scopes.  Can be set by
+            HPEGL_IAM_SCOPES env-var`,
+	}
+
+	providerSchema["iam_audience"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_IAM_AUDIENCE", ""),
+		Description: `The audience asked for when generating tokens for API-vended service clients, no audience is
+            asked for if this isn't set.  Services may ask for a different audience.  Can be set by
+            HPEGL_IAM_AUDIENCE env-var`,
+	}
+
 	providerSchema["api_vended_service_client"] = &schema.Schema{
 		Type:        schema.TypeBool,
 		Optional:    true,
@@ -94,6 +154,14 @@ func Schema() map[string]*schema.Schema {
             i.e. the client is API-vended.  The value can be set using the HPEGL_API_VENDED_SERVICE_CLIENT env-var.`,
 	}
 
+	providerSchema["iam_device_client_id"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_IAM_DEVICE_CLIENT_ID", ""),
+		Description: `The id of the public IAM client used for device login, see devicecode.NewHandler.
+            Can be set by HPEGL_IAM_DEVICE_CLIENT_ID env-var`,
+	}
+
 	providerSchema["tenant_id"] = &schema.Schema{
 		Type:        schema.TypeString,
 		Optional:    true,
@@ -115,9 +183,93 @@ func Schema() map[string]*schema.Schema {
 		Description: "The user secret to be used, can be set by HPEGL_USER_SECRET env-var",
 	}
 
+	providerSchema["credentials_file"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_CREDENTIALS_FILE", ""),
+		Description: `A shared credentials file, consulted if tenant_id, user_id and user_secret aren't set in the
+            provider config or env-vars.  Defaults to .hpegl/credentials in the user's home directory.  Can be set
+            by HPEGL_CREDENTIALS_FILE env-var`,
+	}
+
+	providerSchema["credentials_profile"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_CREDENTIALS_PROFILE", "default"),
+		Description: `The profile in the shared credentials file to be used.  Defaults to "default".  Can be set by
+            HPEGL_CREDENTIALS_PROFILE env-var`,
+	}
+
+	providerSchema["credentials_exec"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_CREDENTIALS_EXEC", ""),
+		Description: `A command that writes tenant_id, user_id and user_secret to stdout as JSON, run if the
+            credentials aren't found elsewhere.  The command is split on white space and isn't run by a shell.
+            Can be set by HPEGL_CREDENTIALS_EXEC env-var`,
+	}
+
+	providerSchema["user_private_key_file"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_USER_PRIVATE_KEY_FILE", ""),
+		Description: `A PEM file containing an unencrypted RSA or EC private key.  If set the service client
+            authenticates with a JWT signed by this key rather than with user_secret.  Can be set by
+            HPEGL_USER_PRIVATE_KEY_FILE env-var`,
+	}
+
+	providerSchema["user_private_key_id"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Optional:    true,
+		DefaultFunc: schema.EnvDefaultFunc("HPEGL_USER_PRIVATE_KEY_ID", ""),
+		Description: `The id of the key in user_private_key_file, sent as the "kid" header of the signed JWT.  Can be
+            set by HPEGL_USER_PRIVATE_KEY_ID env-var`,
+	}
+
 	return providerSchema
 }
 
+// ServiceCredentialsSchema returns the optional schema entries for a service block that declare credentials
+// for the service, for use in a service's ProviderSchemaEntry.  Credentials that aren't set in the service
+// block fall back to the top-level provider credentials, see serviceclient.NewServiceHandlers.
+func ServiceCredentialsSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"iam_service_url": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The IAM service URL to be used to generate tokens for this service",
+		},
+		"tenant_id": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The tenant-id to be used for this service",
+		},
+		"user_id": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "The user id to be used for this service",
+		},
+		"user_secret": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "The user secret to be used for this service",
+		},
+	}
+}
+
+// AddServiceCredentialsSchema helper function to add the ServiceCredentialsSchema entries to the schema of
+// a service block.  The service's own entries take precedence.
+func AddServiceCredentialsSchema(s map[string]*schema.Schema) map[string]*schema.Schema {
+	for k, v := range ServiceCredentialsSchema() {
+		if _, ok := s[k]; !ok {
+			s[k] = v
+		}
+	}
+
+	return s
+}
+
 // ServiceRegistrationSlice helper function to return []registration.ServiceRegistration from
 // registration.ServiceRegistration input
 // For use in service provider repos
@@ -168,3 +168,21 @@ func TestNewProviderFunc(t *testing.T) {
 		})
 	}
 }
+
+func TestAddServiceCredentialsSchema(t *testing.T) {
+	t.Parallel()
+	own := &schema.Schema{Type: schema.TypeString, Required: true}
+	s := AddServiceCredentialsSchema(map[string]*schema.Schema{
+		"api_url": {Type: schema.TypeString, Optional: true},
+		"user_id": own,
+	})
+
+	for k := range ServiceCredentialsSchema() {
+		assert.Contains(t, s, k)
+	}
+	assert.Contains(t, s, "api_url")
+	// The service's own entries take precedence
+	assert.Equal(t, own, s["user_id"])
+	assert.True(t, s["user_secret"].Sensitive)
+	assert.NoError(t, schema.InternalMap(s).InternalValidate(nil))
+}
@@ -25,3 +25,14 @@ type ServiceRegistration interface {
 	// the relevant service block is present if it is needed.
 	ProviderSchemaEntry() *schema.Resource
 }
+
+// ServiceTokenConfig can be implemented by a ServiceRegistration whose service needs differently scoped
+// tokens from the rest of the provider.  A token Handler is then created for the service, and its token
+// retrieve function is stored at the common.ServiceTokenRetrieveFunctionKey for the service.
+type ServiceTokenConfig interface {
+	// TokenScopes returns the scopes to ask for, if empty the provider's iam_scopes are used
+	TokenScopes() []string
+
+	// TokenAudience returns the audience to ask for, if empty the provider's iam_audience is used
+	TokenAudience() string
+}
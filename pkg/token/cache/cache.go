@@ -0,0 +1,233 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+// Package cache is an on-disk cache of tokens that is shared between the provider processes started by
+// terraform runs, so that each process doesn't have to get its own token from IAM.
+package cache
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/filelock"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+)
+
+const (
+	// keyDerivationLabel is mixed into the secret to derive the encryption key, so that the key isn't
+	// used for anything else
+	keyDerivationLabel = "hpegl-provider-lib token cache v1"
+
+	// defaultLockTimeout bounds the wait for the lock on an entry, e.g. if another process is stuck holding it
+	defaultLockTimeout = 30 * time.Second
+)
+
+// Key identifies a cached token
+type Key struct {
+	Issuer   string `json:"issuer"`
+	ClientID string `json:"client_id"`
+	TenantID string `json:"tenant_id"`
+	Scope    string `json:"scope"`
+	Audience string `json:"audience,omitempty"`
+}
+
+// FetchFunc gets a new token when there isn't a valid one in the cache
+type FetchFunc func(ctx context.Context) (*common.Token, error)
+
+// FileCache caches tokens in a directory, one encrypted file per Key.  Each file is encrypted with
+// AES-GCM using a key derived from the client secret, files written with a different secret are
+// ignored.  Access to each file is serialised with a lock file, so that when several processes need
+// a token at the same time only one of them gets it from IAM.
+type FileCache struct {
+	dir         string
+	aead        cipher.AEAD
+	lockTimeout time.Duration
+}
+
+// DefaultDir returns the default cache directory, hpegl/token-cache under os.UserConfigDir
+func DefaultDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "hpegl", "token-cache"), nil
+}
+
+// New creates a FileCache in dir, DefaultDir is used if dir is empty.  secret is the client secret the
+// cached tokens are encrypted with.
+func New(dir, secret string) (*FileCache, error) {
+	if secret == "" {
+		return nil, errors.New("token cache: a secret must be provided")
+	}
+
+	if dir == "" {
+		var err error
+		if dir, err = DefaultDir(); err != nil {
+			return nil, fmt.Errorf("token cache: %w", err)
+		}
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(keyDerivationLabel))
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileCache{dir: dir, aead: aead, lockTimeout: defaultLockTimeout}, nil
+}
+
+// Fetch returns the cached token for key if its time-to-expiry is > common.TimeToTokenExpiry and it isn't
+// current, the token the caller already has.  Otherwise the token got by calling fetch is cached and returned.
+// The lock on the entry for key is held while fetch is called.  If ctx is done while waiting for the lock
+// ctx.Err() is returned, and if the lock isn't got within 30 seconds fetch is called without it.  Failures to
+// read or write the cache are logged, and fetch is used, they are never returned.
+func (c *FileCache) Fetch(ctx context.Context, key Key, current *common.Token, fetch FetchFunc) (*common.Token, error) {
+	path, aad, err := c.entry(key)
+	if err != nil {
+		log.Printf("[WARN] token cache: %s", err)
+
+		return fetch(ctx)
+	}
+
+	if err = os.MkdirAll(c.dir, 0700); err != nil {
+		log.Printf("[WARN] token cache: %s", err)
+
+		return fetch(ctx)
+	}
+
+	lockCtx, cancel := context.WithTimeout(ctx, c.lockTimeout)
+	unlock, err := filelock.LockPathContext(lockCtx, path+".lock")
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.Printf("[WARN] token cache: %s", err)
+
+		return fetch(ctx)
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			log.Printf("[WARN] token cache: %s", err)
+		}
+	}()
+
+	token, err := c.read(path, aad)
+	switch {
+	case err != nil:
+		log.Printf("[DEBUG] token cache: ignoring %s: %s", path, err)
+	case token != nil && time.Until(token.Expiry) > common.TimeToTokenExpiry*time.Second &&
+		(current == nil || token.AccessToken != current.AccessToken):
+		log.Printf("[DEBUG] token cache: using cached token from %s", path)
+
+		return token, nil
+	}
+
+	token, err = fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.write(path, aad, token); err != nil {
+		log.Printf("[WARN] token cache: failed to write %s: %s", path, err)
+	}
+
+	return token, nil
+}
+
+// entry returns the path of the file for key, and the additional data used to authenticate it so that
+// the file for one key can't be used for another
+func (c *FileCache) entry(key Key) (string, []byte, error) {
+	aad, err := json.Marshal(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sum := sha256.Sum256(aad)
+
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])), aad, nil
+}
+
+// read returns the token in the file at path, or nil if there is no file
+func (c *FileCache) read(path string, aad []byte) (*common.Token, error) {
+	b, err := ioutil.ReadFile(filepath.Clean(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(b) < nonceSize {
+		return nil, errors.New("file is too short")
+	}
+
+	plaintext, err := c.aead.Open(nil, b[:nonceSize], b[nonceSize:], aad)
+	if err != nil {
+		return nil, err
+	}
+
+	token := new(common.Token)
+	if err = json.Unmarshal(plaintext, token); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// write encrypts token and writes it to a temporary file that is then renamed to path, so that the file
+// at path is never partially written.  Refresh tokens aren't cached.
+func (c *FileCache) write(path string, aad []byte, token *common.Token) error {
+	cached := *token
+	cached.RefreshToken = ""
+
+	plaintext, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(c.dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint errcheck
+
+	if _, err = f.Write(c.aead.Seal(nonce, nonce, plaintext, aad)); err != nil {
+		_ = f.Close()
+
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
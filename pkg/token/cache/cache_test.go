@@ -0,0 +1,261 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/filelock"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+)
+
+var testKey = Key{Issuer: "https://iam.example.com", ClientID: "client", TenantID: "tenant", Scope: "hpe-tenant"}
+
+// counter returns a FetchFunc that returns a new token, with the given lifetime, on each call
+func counter(calls *int32, lifetime time.Duration) FetchFunc {
+	return func(_ context.Context) (*common.Token, error) {
+		n := atomic.AddInt32(calls, 1)
+
+		return &common.Token{
+			AccessToken:  fmt.Sprintf("token-%d", n),
+			TokenType:    common.TokenTypeBearer,
+			Expiry:       time.Now().Add(lifetime).Truncate(time.Second),
+			RefreshToken: "refresh",
+		}, nil
+	}
+}
+
+func TestFileCacheFetch(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	var calls int32
+
+	// Each FileCache stands in for a separate provider process
+	for i := 0; i < 3; i++ {
+		c, err := New(dir, "secret")
+		require.NoError(t, err)
+
+		token, err := c.Fetch(context.Background(), testKey, nil, counter(&calls, time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, "token-1", token.AccessToken)
+		assert.Equal(t, common.TokenTypeBearer, token.TokenType)
+	}
+	assert.Equal(t, int32(1), calls)
+
+	// A different key gets its own token
+	c, err := New(dir, "secret")
+	require.NoError(t, err)
+	other := testKey
+	other.TenantID = "other-tenant"
+	token, err := c.Fetch(context.Background(), other, nil, counter(&calls, time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token.AccessToken)
+}
+
+func TestFileCacheFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	var calls int32
+
+	c, err := New(dir, "secret")
+	require.NoError(t, err)
+	_, err = c.Fetch(context.Background(), testKey, nil, counter(&calls, time.Hour))
+	require.NoError(t, err)
+
+	path, _, err := c.entry(testKey)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	// The token is encrypted, and refresh tokens aren't cached
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "token-1")
+	token, err := c.read(path, mustAAD(t, c, testKey))
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token.AccessToken)
+	assert.Equal(t, "", token.RefreshToken)
+
+	// No temporary files are left behind
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmp*"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func mustAAD(t *testing.T, c *FileCache, key Key) []byte {
+	t.Helper()
+	_, aad, err := c.entry(key)
+	require.NoError(t, err)
+
+	return aad
+}
+
+func TestFileCacheMiss(t *testing.T) {
+	t.Parallel()
+	testcases := []struct {
+		name     string
+		secret   string
+		lifetime time.Duration
+		current  *common.Token
+	}{
+		{
+			name:     "different secret",
+			secret:   "rotated-secret",
+			lifetime: time.Hour,
+		},
+		{
+			name:     "token about to expire",
+			secret:   "secret",
+			lifetime: time.Minute,
+		},
+		{
+			name:     "cached token is the current token",
+			secret:   "secret",
+			lifetime: time.Hour,
+			current:  &common.Token{AccessToken: "token-1"},
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			dir := t.TempDir()
+			var calls int32
+
+			c, err := New(dir, "secret")
+			require.NoError(t, err)
+			_, err = c.Fetch(context.Background(), testKey, nil, counter(&calls, tc.lifetime))
+			require.NoError(t, err)
+
+			c, err = New(dir, tc.secret)
+			require.NoError(t, err)
+			token, err := c.Fetch(context.Background(), testKey, tc.current, counter(&calls, time.Hour))
+			require.NoError(t, err)
+			assert.Equal(t, "token-2", token.AccessToken)
+
+			// The new token replaces the cached one
+			token, err = c.Fetch(context.Background(), testKey, nil, counter(&calls, time.Hour))
+			require.NoError(t, err)
+			assert.Equal(t, "token-2", token.AccessToken)
+		})
+	}
+}
+
+func TestFileCacheCorruptFile(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	var calls int32
+
+	c, err := New(dir, "secret")
+	require.NoError(t, err)
+	path, _, err := c.entry(testKey)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte("corrupt"), 0600))
+
+	token, err := c.Fetch(context.Background(), testKey, nil, counter(&calls, time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token.AccessToken)
+}
+
+func TestFileCacheFetchError(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	errFetch := errors.New("fetch error")
+
+	c, err := New(dir, "secret")
+	require.NoError(t, err)
+	token, err := c.Fetch(context.Background(), testKey, nil, func(_ context.Context) (*common.Token, error) {
+		return nil, errFetch
+	})
+	assert.Nil(t, token)
+	assert.Equal(t, errFetch, err)
+
+	// Nothing is cached
+	path, _, err := c.entry(testKey)
+	require.NoError(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileCacheConcurrent(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	var calls int32
+	fetch := counter(&calls, time.Hour)
+	slowFetch := func(ctx context.Context) (*common.Token, error) {
+		time.Sleep(10 * time.Millisecond)
+
+		return fetch(ctx)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := New(dir, "secret")
+			if !assert.NoError(t, err) {
+				return
+			}
+			token, err := c.Fetch(context.Background(), testKey, nil, slowFetch)
+			assert.NoError(t, err)
+			assert.Equal(t, "token-1", token.AccessToken)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestFileCacheLockHeld(t *testing.T) {
+	t.Parallel()
+	c, err := New(t.TempDir(), "secret")
+	require.NoError(t, err)
+	c.lockTimeout = 50 * time.Millisecond
+	path, _, err := c.entry(testKey)
+	require.NoError(t, err)
+
+	// Another process is stuck holding the lock
+	unlock, err := filelock.LockPath(path + ".lock")
+	require.NoError(t, err)
+	defer unlock() // nolint errcheck
+
+	// The caller stops waiting when its context is done
+	var calls int32
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	token, err := c.Fetch(ctx, testKey, nil, counter(&calls, time.Hour))
+	assert.Nil(t, token)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, int32(0), calls)
+
+	// Once the lock timeout has passed the token is fetched without the lock, and isn't cached
+	token, err = c.Fetch(context.Background(), testKey, nil, counter(&calls, time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token.AccessToken)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNewNoSecret(t *testing.T) {
+	t.Parallel()
+	_, err := New(t.TempDir(), "")
+	assert.EqualError(t, err, "token cache: a secret must be provided")
+}
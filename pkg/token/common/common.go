@@ -2,21 +2,35 @@
 
 package common
 
+import "errors"
+
 const (
 	TokenRetrieveFunctionKey = "tokenRetrieveFunc"
+	// TenantTokenRetrieveFunctionKey is the key at which a retrieve.TenantTokenRetrieveFuncCtx is stored,
+	// if the provider supports operations in other tenants
+	TenantTokenRetrieveFunctionKey = "tenantTokenRetrieveFunc"
 	// TimeToTokenExpiry is seconds in int64, not time.Second
 	// This constant should be used in all handler code
 	TimeToTokenExpiry = 120
 )
 
+// ServiceTokenRetrieveFunctionKey returns the key at which the token retrieve function for the service
+// serviceName is stored, if the service needs differently scoped tokens from the rest of the provider
+func ServiceTokenRetrieveFunctionKey(serviceName string) string {
+	return TokenRetrieveFunctionKey + "." + serviceName
+}
+
+// ErrHandlerClosed is returned by a token Handler once it has been closed
+var ErrHandlerClosed = errors.New("token handler is closed")
+
 // Result the result struct sent back on the resultCh of a token Handler
 type Result struct {
 	Token string
 	Err   error
 }
 
-// TokenChannelInterface the interface that is implemented by a token Handler
-// This interface is used in retrieve.NewTokenRetrieveFunc
+// TokenChannelInterface the interface that is implemented by a channel-based token Handler
+// This interface is used in retrieve.NewTokenRetrieveFunc, new Handlers should implement TokenSource
 type TokenChannelInterface interface {
 	TokenChannels() (chan Result, chan int)
 }
@@ -0,0 +1,117 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package common
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenTypeBearer the type of the tokens issued by IAM
+const TokenTypeBearer = "Bearer"
+
+// Token a token along with its type and expiry, and the scope and refresh token if IAM returned them
+type Token struct {
+	AccessToken string
+	TokenType   string
+	// Expiry is the zero time if the expiry of the token isn't known
+	Expiry       time.Time
+	Scope        string
+	RefreshToken string
+}
+
+// OAuth2 converts the Token into an oauth2.Token
+func (t *Token) OAuth2() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  t.AccessToken,
+		TokenType:    t.TokenType,
+		RefreshToken: t.RefreshToken,
+		Expiry:       t.Expiry,
+	}
+}
+
+// TokenSource the interface implemented by a token Handler that computes tokens on demand
+// This interface is used in retrieve.NewTokenRetrieveFunc in preference to TokenChannelInterface
+type TokenSource interface {
+	Token(ctx context.Context) (*Token, error)
+}
+
+// TenantTokenSource the interface implemented by a token Handler that computes tokens for any tenant on demand
+// This interface is used in retrieve.NewTenantTokenRetrieveFunc
+type TenantTokenSource interface {
+	TenantToken(ctx context.Context, tenantID string) (*Token, error)
+}
+
+// NewChannelTokenSource adapts a channel-based token Handler to a TokenSource, for use by code that has
+// migrated to TokenSource while the Handler has not.  The Expiry of the tokens returned isn't known.
+func NewChannelTokenSource(channelInterface TokenChannelInterface) TokenSource {
+	resCh, _ := channelInterface.TokenChannels()
+
+	return channelTokenSource{resCh: resCh}
+}
+
+type channelTokenSource struct {
+	resCh chan Result
+}
+
+func (c channelTokenSource) Token(ctx context.Context) (*Token, error) {
+	select {
+	case res := <-c.resCh:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+
+		return &Token{AccessToken: res.Token, TokenType: TokenTypeBearer}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// OAuth2TokenSource adapts a TokenSource to an oauth2.TokenSource, ctx is used for every token request
+func OAuth2TokenSource(ctx context.Context, ts TokenSource) oauth2.TokenSource {
+	return oauth2TokenSource{ctx: ctx, ts: ts}
+}
+
+type oauth2TokenSource struct {
+	ctx context.Context // nolint containedctx
+	ts  TokenSource
+}
+
+func (o oauth2TokenSource) Token() (*oauth2.Token, error) {
+	token, err := o.ts.Token(o.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return token.OAuth2(), nil
+}
+
+// FromOAuth2TokenSource adapts an oauth2.TokenSource to a TokenSource.  oauth2.TokenSource doesn't take a
+// context, so the context is only checked before a token is asked for.
+func FromOAuth2TokenSource(ts oauth2.TokenSource) TokenSource {
+	return fromOAuth2TokenSource{ts: ts}
+}
+
+type fromOAuth2TokenSource struct {
+	ts oauth2.TokenSource
+}
+
+func (f fromOAuth2TokenSource) Token(ctx context.Context) (*Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	token, err := f.ts.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Token{
+		AccessToken:  token.AccessToken,
+		TokenType:    token.Type(),
+		Expiry:       token.Expiry,
+		RefreshToken: token.RefreshToken,
+	}, nil
+}
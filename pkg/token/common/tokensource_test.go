@@ -0,0 +1,84 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+type channelHandler struct {
+	resultCh chan Result
+}
+
+func (c channelHandler) TokenChannels() (chan Result, chan int) {
+	return c.resultCh, make(chan int)
+}
+
+type staticTokenSource struct {
+	token *Token
+	err   error
+}
+
+func (s staticTokenSource) Token(ctx context.Context) (*Token, error) {
+	return s.token, s.err
+}
+
+func TestNewChannelTokenSource(t *testing.T) {
+	t.Parallel()
+	h := channelHandler{resultCh: make(chan Result, 2)}
+	ts := NewChannelTokenSource(h)
+
+	h.resultCh <- Result{Token: "token"}
+	token, err := ts.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &Token{AccessToken: "token", TokenType: TokenTypeBearer}, token)
+
+	h.resultCh <- Result{Err: errors.New("failed")}
+	_, err = ts.Token(context.Background())
+	assert.EqualError(t, err, "failed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ts.Token(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestOAuth2TokenSource(t *testing.T) {
+	t.Parallel()
+	expiry := time.Now().Add(time.Hour)
+	ts := OAuth2TokenSource(context.Background(), staticTokenSource{
+		token: &Token{AccessToken: "token", TokenType: TokenTypeBearer, Expiry: expiry},
+	})
+
+	token, err := ts.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token.AccessToken)
+	assert.Equal(t, TokenTypeBearer, token.Type())
+	assert.Equal(t, expiry, token.Expiry)
+	assert.True(t, token.Valid())
+
+	ts = OAuth2TokenSource(context.Background(), staticTokenSource{err: errors.New("failed")})
+	_, err = ts.Token()
+	assert.EqualError(t, err, "failed")
+}
+
+func TestFromOAuth2TokenSource(t *testing.T) {
+	t.Parallel()
+	expiry := time.Now().Add(time.Hour)
+	ts := FromOAuth2TokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token", Expiry: expiry}))
+
+	token, err := ts.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, &Token{AccessToken: "token", TokenType: TokenTypeBearer, Expiry: expiry}, token)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ts.Token(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,173 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+// Package credentials resolves the service-client credentials used to get tokens from a chain of sources:
+// the provider config, the environment, a shared credentials file, the .gltform file and an exec plugin.
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+const (
+	// TenantIDEnv the env-var holding the tenant id
+	TenantIDEnv = "HPEGL_TENANT_ID"
+	// UserIDEnv the env-var holding the service-client id
+	UserIDEnv = "HPEGL_USER_ID"
+	// UserSecretEnv the env-var holding the service-client secret
+	UserSecretEnv = "HPEGL_USER_SECRET"
+)
+
+// ErrNoCredentials is returned by a CredentialProvider that has no credentials, the next provider in a
+// Chain is then consulted
+var ErrNoCredentials = errors.New("no service-client credentials found")
+
+// Credentials service-client credentials, Source is the name of the CredentialProvider they came from
+type Credentials struct {
+	TenantID     string `json:"tenant_id" yaml:"tenant_id"`
+	ClientID     string `json:"user_id" yaml:"user_id"`
+	ClientSecret string `json:"user_secret" yaml:"user_secret"`
+	Source       string `json:"-" yaml:"-"`
+}
+
+// CredentialProvider a source of service-client credentials
+type CredentialProvider interface {
+	// Name is the name of the source, used in logs
+	Name() string
+	// Retrieve returns the credentials, or ErrNoCredentials if the source doesn't have any.  The returned
+	// credentials may be partial, e.g. only a tenant id, in which case the next provider is consulted.
+	Retrieve(ctx context.Context) (*Credentials, error)
+}
+
+// Chain is a list of CredentialProviders consulted in order
+type Chain []CredentialProvider
+
+// Name implements CredentialProvider
+func (c Chain) Name() string {
+	return "credential chain"
+}
+
+// Retrieve returns the credentials of the providers in the chain merged field by field, the tenant id, client
+// id and client secret each come from the first provider that has them, so that e.g. the client id can be set
+// in the provider config and the secret in the environment.  The chain stops once all three are found.
+// Source is the name of the provider of the client id.  A provider returning an error other than
+// ErrNoCredentials stops the chain.  ErrNoCredentials is returned if no provider has a client id.
+func (c Chain) Retrieve(ctx context.Context) (*Credentials, error) {
+	merged := &Credentials{}
+	var tenantSource, secretSource string
+	for _, p := range c {
+		creds, err := p.Retrieve(ctx)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s credentials: %w", p.Name(), err)
+		}
+
+		if merged.TenantID == "" && creds.TenantID != "" {
+			merged.TenantID, tenantSource = creds.TenantID, p.Name()
+		}
+		if merged.ClientID == "" && creds.ClientID != "" {
+			merged.ClientID, merged.Source = creds.ClientID, p.Name()
+		}
+		if merged.ClientSecret == "" && creds.ClientSecret != "" {
+			merged.ClientSecret, secretSource = creds.ClientSecret, p.Name()
+		}
+		if merged.TenantID != "" && merged.ClientID != "" && merged.ClientSecret != "" {
+			break
+		}
+	}
+
+	if merged.ClientID == "" {
+		return nil, ErrNoCredentials
+	}
+
+	log.Printf("[INFO] using service-client id from %s", merged.Source)
+	if secretSource != "" {
+		log.Printf("[INFO] using service-client secret from %s", secretSource)
+	}
+	if tenantSource != "" {
+		log.Printf("[INFO] using tenant id from %s", tenantSource)
+	}
+
+	return merged, nil
+}
+
+// DefaultChain returns the chain of CredentialProviders configured by the provider schema: the provider
+// config, the environment, the shared credentials file, the .gltform file and, if credentials_exec is set,
+// the exec plugin
+func DefaultChain(d *schema.ResourceData) Chain {
+	chain := Chain{
+		NewStaticProvider("provider config", &Credentials{
+			TenantID:     d.Get("tenant_id").(string),
+			ClientID:     d.Get("user_id").(string),
+			ClientSecret: d.Get("user_secret").(string),
+		}),
+		NewEnvProvider(),
+		NewSharedFileProvider(d.Get("credentials_file").(string), d.Get("credentials_profile").(string)),
+		NewGLTFormProvider(),
+	}
+
+	if command := d.Get("credentials_exec").(string); command != "" {
+		chain = append(chain, NewExecProvider(command))
+	}
+
+	return chain
+}
+
+// StaticProvider a CredentialProvider for fixed credentials, e.g. from the provider config
+type StaticProvider struct {
+	name  string
+	creds Credentials
+}
+
+// NewStaticProvider creates a StaticProvider called name for creds
+func NewStaticProvider(name string, creds *Credentials) *StaticProvider {
+	return &StaticProvider{name: name, creds: *creds}
+}
+
+// Name implements CredentialProvider
+func (p *StaticProvider) Name() string {
+	return p.name
+}
+
+// Retrieve implements CredentialProvider
+func (p *StaticProvider) Retrieve(_ context.Context) (*Credentials, error) {
+	return result(p.creds)
+}
+
+// EnvProvider a CredentialProvider for the HPEGL_TENANT_ID, HPEGL_USER_ID and HPEGL_USER_SECRET env-vars
+type EnvProvider struct{}
+
+// NewEnvProvider creates an EnvProvider
+func NewEnvProvider() *EnvProvider {
+	return &EnvProvider{}
+}
+
+// Name implements CredentialProvider
+func (p *EnvProvider) Name() string {
+	return "environment"
+}
+
+// Retrieve implements CredentialProvider
+func (p *EnvProvider) Retrieve(_ context.Context) (*Credentials, error) {
+	return result(Credentials{
+		TenantID:     os.Getenv(TenantIDEnv),
+		ClientID:     os.Getenv(UserIDEnv),
+		ClientSecret: os.Getenv(UserSecretEnv),
+	})
+}
+
+// result returns a copy of creds, or ErrNoCredentials if creds is empty
+func result(creds Credentials) (*Credentials, error) {
+	if creds.TenantID == "" && creds.ClientID == "" && creds.ClientSecret == "" {
+		return nil, ErrNoCredentials
+	}
+
+	return &creds, nil
+}
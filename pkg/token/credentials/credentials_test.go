@@ -0,0 +1,309 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/provider"
+)
+
+const (
+	// execHelperEnv is set when the test binary is run as an exec plugin by TestExecProvider
+	execHelperEnv = "CREDENTIALS_TEST_EXEC_HELPER"
+
+	sharedFile = `
+default:
+  tenant_id: default-tenant
+  user_id: default-id
+  user_secret: default-secret
+prod:
+  user_id: prod-id
+  user_secret: prod-secret
+`
+)
+
+// errorProvider a CredentialProvider that returns an error
+type errorProvider struct {
+	err error
+}
+
+func (p errorProvider) Name() string { return "error provider" }
+
+func (p errorProvider) Retrieve(_ context.Context) (*Credentials, error) { return nil, p.err }
+
+func TestChainRetrieve(t *testing.T) {
+	t.Parallel()
+	errProvider := errors.New("provider error")
+
+	testcases := []struct {
+		name    string
+		chain   Chain
+		want    *Credentials
+		wantErr error
+	}{
+		{
+			name: "first provider with a client id wins",
+			chain: Chain{
+				NewStaticProvider("empty", &Credentials{}),
+				NewStaticProvider("first", &Credentials{TenantID: "t1", ClientID: "id1", ClientSecret: "s1"}),
+				NewStaticProvider("second", &Credentials{TenantID: "t2", ClientID: "id2", ClientSecret: "s2"}),
+			},
+			want: &Credentials{TenantID: "t1", ClientID: "id1", ClientSecret: "s1", Source: "first"},
+		},
+		{
+			name: "tenant id from an earlier provider",
+			chain: Chain{
+				NewStaticProvider("config", &Credentials{TenantID: "t1"}),
+				NewStaticProvider("file", &Credentials{ClientID: "id2", ClientSecret: "s2"}),
+			},
+			want: &Credentials{TenantID: "t1", ClientID: "id2", ClientSecret: "s2", Source: "file"},
+		},
+		{
+			name: "tenant id from a later provider",
+			chain: Chain{
+				NewStaticProvider("config", &Credentials{ClientID: "id1", ClientSecret: "s1"}),
+				NewStaticProvider("file", &Credentials{TenantID: "t2", ClientID: "id2"}),
+			},
+			want: &Credentials{TenantID: "t2", ClientID: "id1", ClientSecret: "s1", Source: "config"},
+		},
+		{
+			name: "each field from the first provider that has it",
+			chain: Chain{
+				NewStaticProvider("config", &Credentials{ClientID: "id1"}),
+				NewStaticProvider("environment", &Credentials{TenantID: "t2", ClientSecret: "s2"}),
+				NewStaticProvider("file", &Credentials{TenantID: "t3", ClientID: "id3", ClientSecret: "s3"}),
+			},
+			want: &Credentials{TenantID: "t2", ClientID: "id1", ClientSecret: "s2", Source: "config"},
+		},
+		{
+			name: "providers after all the fields are found aren't consulted",
+			chain: Chain{
+				NewStaticProvider("config", &Credentials{TenantID: "t1", ClientID: "id1"}),
+				NewStaticProvider("environment", &Credentials{ClientSecret: "s2"}),
+				errorProvider{err: errProvider},
+			},
+			want: &Credentials{TenantID: "t1", ClientID: "id1", ClientSecret: "s2", Source: "config"},
+		},
+		{
+			name: "provider error stops the chain",
+			chain: Chain{
+				NewStaticProvider("config", &Credentials{TenantID: "t1"}),
+				errorProvider{err: errProvider},
+				NewStaticProvider("file", &Credentials{ClientID: "id2", ClientSecret: "s2"}),
+			},
+			wantErr: errProvider,
+		},
+		{
+			name: "no credentials",
+			chain: Chain{
+				NewStaticProvider("config", &Credentials{TenantID: "t1"}),
+				errorProvider{err: ErrNoCredentials},
+			},
+			wantErr: ErrNoCredentials,
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			creds, err := tc.chain.Retrieve(context.Background())
+			if tc.wantErr != nil {
+				assert.True(t, errors.Is(err, tc.wantErr))
+				assert.Nil(t, creds)
+
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, creds)
+		})
+	}
+}
+
+func TestSharedFileProvider(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "credentials")
+	require.NoError(t, ioutil.WriteFile(path, []byte(sharedFile), 0600))
+	badPath := filepath.Join(dir, "bad")
+	require.NoError(t, ioutil.WriteFile(badPath, []byte("- not a map"), 0600))
+
+	testcases := []struct {
+		name    string
+		path    string
+		profile string
+		want    *Credentials
+		wantErr error
+		errMsg  string
+	}{
+		{
+			name: "default profile",
+			path: path,
+			want: &Credentials{TenantID: "default-tenant", ClientID: "default-id", ClientSecret: "default-secret"},
+		},
+		{
+			name:    "named profile",
+			path:    path,
+			profile: "prod",
+			want:    &Credentials{ClientID: "prod-id", ClientSecret: "prod-secret"},
+		},
+		{
+			name:    "missing profile",
+			path:    path,
+			profile: "staging",
+			errMsg:  fmt.Sprintf("profile staging not found in %s", path),
+		},
+		{
+			name:    "missing file",
+			path:    filepath.Join(dir, "missing"),
+			wantErr: ErrNoCredentials,
+		},
+		{
+			name:   "invalid file",
+			path:   badPath,
+			errMsg: badPath + ": yaml: unmarshal errors",
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			creds, err := NewSharedFileProvider(tc.path, tc.profile).Retrieve(context.Background())
+			switch {
+			case tc.wantErr != nil:
+				assert.Equal(t, tc.wantErr, err)
+			case tc.errMsg != "":
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMsg)
+			default:
+				assert.NoError(t, err)
+				assert.Equal(t, tc.want, creds)
+			}
+		})
+	}
+}
+
+// TestExecHelperProcess isn't a real test, it is run as an exec plugin by TestExecProvider
+func TestExecHelperProcess(t *testing.T) {
+	switch os.Getenv(execHelperEnv) {
+	case "":
+		t.Skip("only run as an exec plugin")
+	case "ok":
+		fmt.Print(`{"tenant_id":"exec-tenant","user_id":"exec-id","user_secret":"exec-secret"}`)
+	case "invalid":
+		fmt.Print("not json")
+	case "fail":
+		fmt.Fprint(os.Stderr, "secret store unavailable")
+		os.Exit(3)
+	}
+	os.Exit(0)
+}
+
+func TestExecProvider(t *testing.T) {
+	testcases := []struct {
+		name   string
+		helper string
+		want   *Credentials
+		errMsg string
+	}{
+		{
+			name:   "credentials",
+			helper: "ok",
+			want:   &Credentials{TenantID: "exec-tenant", ClientID: "exec-id", ClientSecret: "exec-secret"},
+		},
+		{
+			name:   "invalid output",
+			helper: "invalid",
+			errMsg: "invalid output",
+		},
+		{
+			name:   "command fails",
+			helper: "fail",
+			errMsg: "exit status 3: secret store unavailable",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The env-var is inherited by the exec plugin, so these tests can't be run in parallel
+			require.NoError(t, os.Setenv(execHelperEnv, tc.helper))
+			defer os.Unsetenv(execHelperEnv)
+
+			p := NewExecProvider(os.Args[0] + " -test.run=^TestExecHelperProcess$")
+			creds, err := p.Retrieve(context.Background())
+			if tc.errMsg != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMsg)
+
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, creds)
+		})
+	}
+}
+
+func TestDefaultChain(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(t.TempDir(), "credentials")
+	require.NoError(t, ioutil.WriteFile(path, []byte(sharedFile), 0600))
+
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"tenant_id":           "config-tenant",
+		"credentials_file":    path,
+		"credentials_profile": "prod",
+		"credentials_exec":    "plugin --flag",
+	})
+
+	chain := DefaultChain(d)
+	names := make([]string, 0, len(chain))
+	for _, p := range chain {
+		names = append(names, p.Name())
+	}
+	assert.Equal(t, []string{"provider config", "environment", "shared credentials file profile prod", ".gltform",
+		"exec plugin"}, names)
+
+	// The tenant id from the config is used with the credentials from the shared credentials file, assuming
+	// HPEGL_USER_ID isn't set in the environment of the test
+	if os.Getenv(UserIDEnv) == "" {
+		creds, err := chain[:3].Retrieve(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, &Credentials{TenantID: "config-tenant", ClientID: "prod-id", ClientSecret: "prod-secret",
+			Source: "shared credentials file profile prod"}, creds)
+	}
+}
+
+func TestDefaultChainConfigAndEnv(t *testing.T) {
+	// The env-vars are read by the provider schema and the chain, so this test can't be run in parallel
+	for key, value := range map[string]string{TenantIDEnv: "env-tenant", UserIDEnv: "", UserSecretEnv: "env-secret"} {
+		old, ok := os.LookupEnv(key)
+		require.NoError(t, os.Setenv(key, value))
+		if ok {
+			defer os.Setenv(key, old) // nolint errcheck
+		} else {
+			defer os.Unsetenv(key) // nolint errcheck
+		}
+	}
+
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"user_id":          "config-id",
+		"credentials_file": filepath.Join(t.TempDir(), "credentials"),
+	})
+
+	creds, err := DefaultChain(d)[:3].Retrieve(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, &Credentials{TenantID: "env-tenant", ClientID: "config-id", ClientSecret: "env-secret",
+		Source: "provider config"}, creds)
+}
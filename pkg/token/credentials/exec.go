@@ -0,0 +1,67 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// execTimeout bounds the time an exec plugin can take
+const execTimeout = 30 * time.Second
+
+// ExecProvider a CredentialProvider that runs a command, e.g. one that fetches the credentials from a
+// secret store.  The command must write the credentials to stdout as JSON:
+//
+//	{"tenant_id": "<tenant id>", "user_id": "<client id>", "user_secret": "<client secret>"}
+type ExecProvider struct {
+	command string
+}
+
+// NewExecProvider creates an ExecProvider for command, which is split into arguments on white space.  It
+// isn't run by a shell.
+func NewExecProvider(command string) *ExecProvider {
+	return &ExecProvider{command: command}
+}
+
+// Name implements CredentialProvider
+func (p *ExecProvider) Name() string {
+	return "exec plugin"
+}
+
+// Retrieve implements CredentialProvider, the command failing or writing invalid output is an error
+func (p *ExecProvider) Retrieve(ctx context.Context) (*Credentials, error) {
+	args := strings.Fields(p.command)
+	if len(args) == 0 {
+		return nil, errors.New("no command")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, execTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	// #nosec G204 the command is configured by the user running terraform
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %w: %s", args[0], err, msg)
+		}
+
+		return nil, fmt.Errorf("%s: %w", args[0], err)
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("%s: invalid output: %w", args[0], err)
+	}
+
+	return result(creds)
+}
@@ -0,0 +1,119 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/gltform"
+)
+
+// DefaultProfile the profile used in the shared credentials file if none is specified
+const DefaultProfile = "default"
+
+// SharedFileProvider a CredentialProvider for a profile in a shared credentials file.  The file is YAML,
+// keyed by profile name:
+//
+//	default:
+//	  tenant_id: <tenant id>
+//	  user_id: <client id>
+//	  user_secret: <client secret>
+type SharedFileProvider struct {
+	path    string
+	profile string
+}
+
+// DefaultSharedFilePath returns the default path of the shared credentials file, .hpegl/credentials in
+// the user's home directory
+func DefaultSharedFilePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".hpegl", "credentials"), nil
+}
+
+// NewSharedFileProvider creates a SharedFileProvider for profile in the file at path.  DefaultSharedFilePath
+// is used if path is empty, and DefaultProfile if profile is empty.
+func NewSharedFileProvider(path, profile string) *SharedFileProvider {
+	if profile == "" {
+		profile = DefaultProfile
+	}
+
+	return &SharedFileProvider{path: path, profile: profile}
+}
+
+// Name implements CredentialProvider
+func (p *SharedFileProvider) Name() string {
+	return fmt.Sprintf("shared credentials file profile %s", p.profile)
+}
+
+// Retrieve implements CredentialProvider.  A missing file, or a missing profile in the default file, is
+// treated as no credentials, a missing profile in a file that was specified is an error.
+func (p *SharedFileProvider) Retrieve(_ context.Context) (*Credentials, error) {
+	path := p.path
+	if path == "" {
+		var err error
+		if path, err = DefaultSharedFilePath(); err != nil {
+			return nil, ErrNoCredentials
+		}
+	}
+
+	b, err := ioutil.ReadFile(filepath.Clean(path))
+	if os.IsNotExist(err) {
+		return nil, ErrNoCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	profiles := make(map[string]Credentials)
+	if err = yaml.Unmarshal(b, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	creds, ok := profiles[p.profile]
+	if !ok {
+		if p.path == "" && p.profile == DefaultProfile {
+			return nil, ErrNoCredentials
+		}
+
+		return nil, fmt.Errorf("profile %s not found in %s", p.profile, path)
+	}
+
+	return result(creds)
+}
+
+// GLTFormProvider a CredentialProvider for the credentials in the .gltform file, see gltform.GetGLConfig
+type GLTFormProvider struct{}
+
+// NewGLTFormProvider creates a GLTFormProvider
+func NewGLTFormProvider() *GLTFormProvider {
+	return &GLTFormProvider{}
+}
+
+// Name implements CredentialProvider
+func (p *GLTFormProvider) Name() string {
+	return ".gltform"
+}
+
+// Retrieve implements CredentialProvider, a missing or unreadable .gltform file is treated as no credentials
+func (p *GLTFormProvider) Retrieve(_ context.Context) (*Credentials, error) {
+	gljwt, err := gltform.GetGLConfig()
+	if err != nil {
+		return nil, ErrNoCredentials
+	}
+
+	return result(Credentials{
+		TenantID:     gljwt.TenantID,
+		ClientID:     gljwt.UserID,
+		ClientSecret: gljwt.UserSecret,
+	})
+}
@@ -0,0 +1,467 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package devicecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/identitytoken"
+	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
+)
+
+const (
+	// DefaultScope is the scope asked for, offline_access gets a refresh token so that the
+	// user only has to log in once per run
+	DefaultScope = "openid offline_access"
+
+	// grantTypeDeviceCode the grant type used to poll for a token, see RFC 8628 section 3.4
+	grantTypeDeviceCode = "urn:ietf:params:oauth:grant-type:device_code"
+
+	// defaultInterval is the polling interval used if IAM doesn't specify one, in seconds
+	defaultInterval = 5
+
+	// slowDownIncrement is added to the polling interval when IAM responds with slow_down, in seconds
+	slowDownIncrement = 5
+)
+
+var (
+	// ErrAccessDenied is returned if the user denies the device authorization request
+	ErrAccessDenied = errors.New("device login: access denied")
+
+	// ErrExpiredToken is returned if the user doesn't log in before the device code expires
+	ErrExpiredToken = errors.New("device login: device code expired before the login was completed")
+
+	// ErrLoginRequired is returned if the token has expired and can't be refreshed, the provider
+	// has to be reconfigured to log in again
+	ErrLoginRequired = errors.New("device login: token expired and can't be refreshed, log in again")
+)
+
+// Assert that Handler implements common.TokenSource
+var _ common.TokenSource = (*Handler)(nil)
+
+// DeviceAuthorization the response to a device authorization request, see RFC 8628 section 3.2
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// oauthError an OAuth2 error response, see RFC 6749 section 5.2
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Handler a token Handler that gets tokens for a user using the OAuth2 device authorization grant
+// (RFC 8628).  The user is asked to log in when the Handler is created, tokens are then cached and
+// refreshed using the refresh token returned with them.  Tokens are only cached in memory, so the user
+// has to log in again for every Handler, i.e. for every Terraform run.
+type Handler struct {
+	iamServiceURL string
+	clientID      string
+	scope         string
+	httpClient    tokenutil.HttpClient
+	requestOpts   []tokenutil.RequestOpt
+	prompt        func(a *DeviceAuthorization)
+	// second is the duration of the seconds in the polling interval and expiry given by IAM, it is
+	// only changed by tests
+	second time.Duration
+
+	// authorized is closed once the device login is complete, authErr is then set if it failed
+	authorized chan struct{}
+	authErr    error
+	// refreshMu serialises token refreshes
+	refreshMu sync.Mutex
+
+	// mu guards the cached token and closed
+	mu     sync.Mutex
+	token  *common.Token
+	closed bool
+	cancel context.CancelFunc
+}
+
+// CreateOpt - function option definition
+type CreateOpt func(h *Handler)
+
+// WithScope override DefaultScope
+func WithScope(scope string) CreateOpt {
+	return func(h *Handler) {
+		h.scope = scope
+	}
+}
+
+// WithHTTPClient override the http client used for requests to IAM
+func WithHTTPClient(c tokenutil.HttpClient) CreateOpt {
+	return func(h *Handler) {
+		h.httpClient = c
+	}
+}
+
+// WithRetryPolicy override the RetryPolicy used for requests to IAM
+func WithRetryPolicy(p tokenutil.RetryPolicy) CreateOpt {
+	return func(h *Handler) {
+		h.requestOpts = append(h.requestOpts, tokenutil.WithRetryPolicy(p))
+	}
+}
+
+// WithPrompt override the function that is called with the device authorization to tell the user where
+// to log in, by default WritePrompt(os.Stderr).  It is called before NewHandler returns, unlike the
+// warning diagnostic which Terraform only shows once the operation is over.
+func WithPrompt(prompt func(a *DeviceAuthorization)) CreateOpt {
+	return func(h *Handler) {
+		h.prompt = prompt
+	}
+}
+
+// WritePrompt returns a prompt, see WithPrompt, that writes the verification URL and user code to w
+func WritePrompt(w io.Writer) func(a *DeviceAuthorization) {
+	return func(a *DeviceAuthorization) {
+		// nolint errcheck
+		fmt.Fprintf(w, "To log in to HPE GreenLake visit %s and enter the code %s\n", a.verificationURL(), a.UserCode)
+	}
+}
+
+// verificationURL returns the URL the user visits to log in, with the user code filled in if IAM gave one
+func (a *DeviceAuthorization) verificationURL() string {
+	if a.VerificationURIComplete != "" {
+		return a.VerificationURIComplete
+	}
+
+	return a.VerificationURI
+}
+
+// NewHandler creates a new handler, which implements the common.TokenSource interface.  A device
+// authorization is requested from IAM, the user is told where to log in by the prompt, see WithPrompt,
+// and by the warning diagnostic returned.  IAM is then polled in the background until the user has logged in.  Close should be called
+// when the provider is torn down.
+func NewHandler(ctx context.Context, d *schema.ResourceData, opts ...CreateOpt) (*Handler, diag.Diagnostics) {
+	h := &Handler{
+		iamServiceURL: strings.TrimRight(d.Get("iam_service_url").(string), "/"),
+		clientID:      d.Get("iam_device_client_id").(string),
+		scope:         DefaultScope,
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+		prompt:        WritePrompt(os.Stderr),
+		second:        time.Second,
+		authorized:    make(chan struct{}),
+	}
+
+	// run overrides
+	for _, opt := range opts {
+		if opt != nil {
+			opt(h)
+		}
+	}
+
+	if h.clientID == "" {
+		return nil, diag.Errorf("iam_device_client_id must be set to use device login")
+	}
+
+	auth, err := h.requestAuthorization(ctx)
+	if err != nil {
+		return nil, diag.Errorf("device login: error requesting device authorization: %s", err)
+	}
+
+	verificationURL := auth.verificationURL()
+	log.Printf("[INFO] To log in to HPE GreenLake visit %s and enter the code %s", verificationURL, auth.UserCode)
+	if h.prompt != nil {
+		h.prompt(auth)
+	}
+
+	// Polling stops when the device code expires
+	var pollCtx context.Context
+	if auth.ExpiresIn > 0 {
+		pollCtx, h.cancel = context.WithTimeout(context.Background(), time.Duration(auth.ExpiresIn)*h.second)
+	} else {
+		pollCtx, h.cancel = context.WithCancel(context.Background())
+	}
+	go h.poll(pollCtx, auth)
+
+	return h, diag.Diagnostics{{
+		Severity: diag.Warning,
+		Summary:  "HPE GreenLake login required",
+		Detail: fmt.Sprintf("To log in visit %s and enter the code %s.  Terraform will continue once "+
+			"you have logged in.", verificationURL, auth.UserCode),
+	}}
+}
+
+// Token returns the cached token, refreshing it if its time-to-expiry is <= common.TimeToTokenExpiry.  It
+// waits for the user to log in if they haven't yet done so.
+func (h *Handler) Token(ctx context.Context) (*common.Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if h.isClosed() {
+		return nil, common.ErrHandlerClosed
+	}
+
+	select {
+	case <-h.authorized:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if h.authErr != nil {
+		return nil, h.authErr
+	}
+
+	if token, ok := h.validToken(); ok {
+		return token, nil
+	}
+
+	h.refreshMu.Lock()
+	defer h.refreshMu.Unlock()
+
+	// Another caller may have refreshed the token while this one was waiting
+	token, ok := h.validToken()
+	if ok {
+		return token, nil
+	}
+
+	if token == nil {
+		return nil, common.ErrHandlerClosed
+	}
+
+	if token.RefreshToken == "" {
+		return nil, ErrLoginRequired
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", "refresh_token")
+	params.Add("refresh_token", token.RefreshToken)
+	params.Add("client_id", h.clientID)
+
+	token, err := h.requestToken(ctx, params)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrLoginRequired, err)
+	}
+
+	return h.storeToken(token)
+}
+
+// Close stops polling for the user to log in.  Callers waiting on a token, and any subsequent callers,
+// get common.ErrHandlerClosed.  It is safe to call more than once.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	h.cancel()
+
+	return nil
+}
+
+func (h *Handler) isClosed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.closed
+}
+
+// validToken returns a copy of the cached token, and whether it is valid.  The token returned is only nil
+// if the Handler is closed, the user has logged in by the time it is called.
+func (h *Handler) validToken() (*common.Token, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed || h.token == nil {
+		return nil, false
+	}
+
+	token := *h.token
+
+	return &token, time.Until(token.Expiry) > common.TimeToTokenExpiry*time.Second
+}
+
+// storeToken caches a token, keeping the previous refresh token if IAM didn't return a new one
+func (h *Handler) storeToken(token *common.Token) (*common.Token, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, common.ErrHandlerClosed
+	}
+
+	if token.TokenType == "" {
+		token.TokenType = common.TokenTypeBearer
+	}
+	if token.RefreshToken == "" && h.token != nil {
+		token.RefreshToken = h.token.RefreshToken
+	}
+	h.token = token
+
+	stored := *token
+
+	return &stored, nil
+}
+
+// requestAuthorization requests a device code and user code from IAM, see RFC 8628 section 3.1
+func (h *Handler) requestAuthorization(ctx context.Context) (*DeviceAuthorization, error) {
+	params := url.Values{}
+	params.Add("client_id", h.clientID)
+	params.Add("scope", h.scope)
+
+	body, status, err := h.post(ctx, fmt.Sprintf("%s/v1/device/authorize", h.iamServiceURL), params)
+	if err != nil {
+		return nil, err
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d: %s", status, body)
+	}
+
+	auth := &DeviceAuthorization{}
+	if err = json.Unmarshal(body, auth); err != nil {
+		return nil, err
+	}
+
+	if auth.DeviceCode == "" || auth.UserCode == "" {
+		return nil, fmt.Errorf("device authorization response is missing the device_code or user_code")
+	}
+
+	return auth, nil
+}
+
+// poll polls IAM for a token until the user has logged in, the device code has expired or ctx is
+// cancelled, see RFC 8628 section 3.4 and 3.5
+func (h *Handler) poll(ctx context.Context, auth *DeviceAuthorization) {
+	defer close(h.authorized)
+
+	interval := auth.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", grantTypeDeviceCode)
+	params.Add("device_code", auth.DeviceCode)
+	params.Add("client_id", h.clientID)
+
+	for {
+		timer := time.NewTimer(time.Duration(interval) * h.second)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			h.authErr = h.pollError(ctx)
+
+			return
+		case <-timer.C:
+		}
+
+		token, err := h.requestToken(ctx, params)
+		switch {
+		case err == nil:
+			_, h.authErr = h.storeToken(token)
+
+			return
+		case errors.Is(err, errAuthorizationPending):
+		case errors.Is(err, errSlowDown):
+			interval += slowDownIncrement
+		case ctx.Err() != nil:
+			h.authErr = h.pollError(ctx)
+
+			return
+		default:
+			h.authErr = err
+
+			return
+		}
+	}
+}
+
+// pollError returns the error for the cancellation of the polling context
+func (h *Handler) pollError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrExpiredToken
+	}
+
+	return common.ErrHandlerClosed
+}
+
+var (
+	errAuthorizationPending = errors.New("authorization_pending")
+	errSlowDown             = errors.New("slow_down")
+)
+
+// requestToken makes a single token request, either a device access token request or a refresh
+func (h *Handler) requestToken(ctx context.Context, params url.Values) (*common.Token, error) {
+	issuedAt := time.Now()
+	body, status, err := h.post(ctx, fmt.Sprintf("%s/v1/token", h.iamServiceURL), params)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == http.StatusOK {
+		var token identitytoken.TokenResponse
+		if err = json.Unmarshal(body, &token); err != nil {
+			return nil, err
+		}
+
+		return token.Token(issuedAt), nil
+	}
+
+	var oauthErr oauthError
+	if err = json.Unmarshal(body, &oauthErr); err != nil || oauthErr.Error == "" {
+		return nil, fmt.Errorf("device login: unexpected status code %d: %s", status, body)
+	}
+
+	switch oauthErr.Error {
+	case "authorization_pending":
+		return nil, errAuthorizationPending
+	case "slow_down":
+		return nil, errSlowDown
+	case "access_denied":
+		return nil, ErrAccessDenied
+	case "expired_token":
+		return nil, ErrExpiredToken
+	}
+
+	return nil, fmt.Errorf("device login: %s: %s", oauthErr.Error, oauthErr.ErrorDescription)
+}
+
+// post makes a form-encoded POST request to IAM and returns the response body and status code
+func (h *Handler) post(ctx context.Context, url string, params url.Values) ([]byte, int, error) {
+	options := tokenutil.NewRequestOptions(h.requestOpts...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := tokenutil.DoRequestWithRetries(ctx, h.httpClient, req, options.RetryPolicy)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return body, resp.StatusCode, nil
+}
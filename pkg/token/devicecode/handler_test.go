@@ -0,0 +1,329 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package devicecode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/internal/iamtest"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/provider"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+)
+
+const (
+	testClientID   = "device-client"
+	testDeviceCode = "device-code"
+	testUserCode   = "ABCD-EFGH"
+)
+
+// withSecond shortens the seconds in the polling interval and expiry given by IAM
+func withSecond(d time.Duration) CreateOpt {
+	return func(h *Handler) {
+		h.second = d
+	}
+}
+
+// deviceIAM is a local fake of the IAM device authorization and token endpoints
+type deviceIAM struct {
+	iamtest.Recorder
+	server *httptest.Server
+
+	mu sync.Mutex
+	// deviceResponses are the errors returned to successive device access token requests, a token
+	// is issued once they are used up.  If denyAll is set every request is answered with it.
+	deviceResponses []string
+	denyAll         string
+	expiresIn       int
+	issued          int
+}
+
+func newDeviceIAM(t *testing.T, expiresIn int, deviceResponses ...string) *deviceIAM {
+	t.Helper()
+	f := &deviceIAM{deviceResponses: deviceResponses, expiresIn: expiresIn}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/device/authorize", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("client_id") != testClientID {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(DeviceAuthorization{
+			DeviceCode:      testDeviceCode,
+			UserCode:        testUserCode,
+			VerificationURI: f.server.URL + "/activate",
+			ExpiresIn:       2000,
+			Interval:        1,
+		})
+	})
+	mux.HandleFunc("/v1/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+		f.Record(r.PostForm)
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		switch r.PostFormValue("grant_type") {
+		case grantTypeDeviceCode:
+			if r.PostFormValue("device_code") != testDeviceCode {
+				f.writeError(w, "invalid_grant")
+
+				return
+			}
+			if f.denyAll != "" {
+				f.writeError(w, f.denyAll)
+
+				return
+			}
+			if len(f.deviceResponses) > 0 {
+				f.writeError(w, f.deviceResponses[0])
+				f.deviceResponses = f.deviceResponses[1:]
+
+				return
+			}
+		case "refresh_token":
+			if r.PostFormValue("refresh_token") != fmt.Sprintf("refresh-%d", f.issued) {
+				f.writeError(w, "invalid_grant")
+
+				return
+			}
+		}
+
+		f.issued++
+		_, _ = fmt.Fprintf(w, `{"access_token":"access-%d","refresh_token":"refresh-%d","token_type":"Bearer","expires_in":%d}`,
+			f.issued, f.issued, f.expiresIn)
+	})
+
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *deviceIAM) writeError(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = fmt.Fprintf(w, `{"error":%q}`, code)
+}
+
+func newTestHandler(t *testing.T, iam *deviceIAM, opts ...CreateOpt) (*Handler, diag.Diagnostics) {
+	t.Helper()
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"iam_service_url":      iam.server.URL,
+		"iam_device_client_id": testClientID,
+	})
+
+	// The default prompt is replaced so that tests don't write to stderr
+	defaults := []CreateOpt{withSecond(time.Millisecond), WithPrompt(func(*DeviceAuthorization) {})}
+
+	return NewHandler(context.Background(), d, append(defaults, opts...)...)
+}
+
+func TestHandlerDeviceLogin(t *testing.T) {
+	t.Parallel()
+	iam := newDeviceIAM(t, 3600, "authorization_pending", "slow_down", "authorization_pending")
+
+	var prompted *DeviceAuthorization
+	handler, diags := newTestHandler(t, iam, WithPrompt(func(a *DeviceAuthorization) { prompted = a }))
+	require.False(t, diags.HasError())
+	defer handler.Close()
+
+	require.Len(t, diags, 1)
+	assert.Equal(t, diag.Warning, diags[0].Severity)
+	assert.Contains(t, diags[0].Detail, iam.server.URL+"/activate")
+	assert.Contains(t, diags[0].Detail, testUserCode)
+	require.NotNil(t, prompted)
+	assert.Equal(t, testUserCode, prompted.UserCode)
+
+	for i := 0; i < 3; i++ {
+		token, err := handler.Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, "access-1", token.AccessToken)
+		assert.Equal(t, common.TokenTypeBearer, token.TokenType)
+	}
+
+	assert.Equal(t, []string{grantTypeDeviceCode, grantTypeDeviceCode, grantTypeDeviceCode, grantTypeDeviceCode},
+		iam.Values("grant_type"))
+}
+
+func TestHandlerDeviceLoginWritePrompt(t *testing.T) {
+	t.Parallel()
+	iam := newDeviceIAM(t, 3600)
+
+	// The prompt is written before NewHandler returns, i.e. while the provider is still being configured
+	var buf bytes.Buffer
+	handler, diags := newTestHandler(t, iam, WithPrompt(WritePrompt(&buf)))
+	require.False(t, diags.HasError())
+	defer handler.Close()
+
+	assert.Equal(t, fmt.Sprintf("To log in to HPE GreenLake visit %s/activate and enter the code %s\n",
+		iam.server.URL, testUserCode), buf.String())
+}
+
+func TestHandlerDeviceLoginRefresh(t *testing.T) {
+	t.Parallel()
+	// Tokens expire within common.TimeToTokenExpiry so every call refreshes the token
+	iam := newDeviceIAM(t, 60)
+
+	handler, diags := newTestHandler(t, iam)
+	require.False(t, diags.HasError())
+	defer handler.Close()
+
+	for i := 2; i <= 3; i++ {
+		token, err := handler.Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("access-%d", i), token.AccessToken)
+	}
+
+	assert.Equal(t, []string{grantTypeDeviceCode, "refresh_token", "refresh_token"}, iam.Values("grant_type"))
+}
+
+func TestHandlerDeviceLoginRefreshRejected(t *testing.T) {
+	t.Parallel()
+	iam := newDeviceIAM(t, 60)
+
+	handler, diags := newTestHandler(t, iam)
+	require.False(t, diags.HasError())
+	defer handler.Close()
+
+	<-handler.authorized
+	handler.mu.Lock()
+	handler.token.RefreshToken = "revoked"
+	handler.mu.Unlock()
+
+	_, err := handler.Token(context.Background())
+	assert.ErrorIs(t, err, ErrLoginRequired)
+}
+
+func TestHandlerDeviceLoginErrors(t *testing.T) {
+	t.Parallel()
+	testcases := []struct {
+		name    string
+		denyAll string
+		wantErr error
+	}{
+		{
+			name:    "access denied",
+			denyAll: "access_denied",
+			wantErr: ErrAccessDenied,
+		},
+		{
+			name:    "device code expired",
+			denyAll: "expired_token",
+			wantErr: ErrExpiredToken,
+		},
+		{
+			name:    "user never logs in",
+			denyAll: "authorization_pending",
+			wantErr: ErrExpiredToken,
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			iam := newDeviceIAM(t, 3600)
+			iam.denyAll = tc.denyAll
+
+			handler, diags := newTestHandler(t, iam)
+			require.False(t, diags.HasError())
+			defer handler.Close()
+
+			_, err := handler.Token(context.Background())
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestHandlerDeviceLoginClose(t *testing.T) {
+	t.Parallel()
+	iam := newDeviceIAM(t, 3600)
+	iam.denyAll = "authorization_pending"
+
+	handler, diags := newTestHandler(t, iam)
+	require.False(t, diags.HasError())
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := handler.Token(context.Background())
+		errCh <- err
+	}()
+
+	assert.NoError(t, handler.Close())
+	assert.NoError(t, handler.Close())
+
+	select {
+	case err := <-errCh:
+		assert.Equal(t, common.ErrHandlerClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Token did not return after Close")
+	}
+}
+
+func TestHandlerDeviceLoginCancelled(t *testing.T) {
+	t.Parallel()
+	iam := newDeviceIAM(t, 3600)
+	iam.denyAll = "authorization_pending"
+
+	handler, diags := newTestHandler(t, iam)
+	require.False(t, diags.HasError())
+	defer handler.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := handler.Token(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestNewHandlerErrors(t *testing.T) {
+	t.Parallel()
+	iam := newDeviceIAM(t, 3600)
+
+	testcases := []struct {
+		name     string
+		clientID string
+	}{
+		{
+			name: "no client id",
+		},
+		{
+			name:     "authorization rejected",
+			clientID: "unknown-client",
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+				"iam_service_url":      iam.server.URL,
+				"iam_device_client_id": tc.clientID,
+			})
+
+			handler, diags := NewHandler(context.Background(), d)
+			assert.Nil(t, handler)
+			assert.True(t, diags.HasError())
+		})
+	}
+}
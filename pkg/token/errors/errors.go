@@ -40,6 +40,11 @@ func (e *BaseError) Error() string {
 	return "An error occurred."
 }
 
+// Unwrap returns the OriginalError, if any, for use with errors.Is and errors.As
+func (e *BaseError) Unwrap() error {
+	return e.OriginalError
+}
+
 type ErrBadRequest struct {
 	BaseError
 }
@@ -49,6 +54,17 @@ func MakeErrBadRequest(errorResponse ErrorResponse) *ErrBadRequest {
 	return &ErrBadRequest{BaseError{ErrorResponse: errorResponse}}
 }
 
+// ErrInvalidGrant is returned when IAM rejects the grant in a token request with the OAuth2
+// invalid_grant error, e.g. because a refresh token has expired or been revoked
+type ErrInvalidGrant struct {
+	BaseError
+}
+
+// MakeErrInvalidGrant helper to create ErrInvalidGrant
+func MakeErrInvalidGrant(errorResponse ErrorResponse) *ErrInvalidGrant {
+	return &ErrInvalidGrant{BaseError{ErrorResponse: errorResponse}}
+}
+
 //ErrForbidden is error type that can be returned from a function and propogated to be handled appropriately
 //Used to indicate insufficient access
 type ErrForbidden struct {
@@ -91,3 +107,53 @@ type ErrInternalError struct {
 func MakeErrInternalError(errorResponse ErrorResponse) *ErrInternalError {
 	return &ErrInternalError{BaseError{ErrorResponse: errorResponse}}
 }
+
+// ErrMalformedJWT is returned when a token can't be parsed as a JWT
+type ErrMalformedJWT struct {
+	BaseError
+}
+
+// MakeErrMalformedJWT helper to create ErrMalformedJWT
+func MakeErrMalformedJWT(err error) *ErrMalformedJWT {
+	return &ErrMalformedJWT{BaseError{Info: "oidc: malformed jwt: " + err.Error(), OriginalError: err}}
+}
+
+// ErrBadPayload is returned when the payload of a JWT isn't valid base64
+type ErrBadPayload struct {
+	BaseError
+}
+
+// MakeErrBadPayload helper to create ErrBadPayload
+func MakeErrBadPayload(err error) *ErrBadPayload {
+	return &ErrBadPayload{BaseError{Info: "oidc: malformed jwt payload: " + err.Error(), OriginalError: err}}
+}
+
+// ErrBadClaims is returned when the claims in the payload of a JWT can't be unmarshalled
+type ErrBadClaims struct {
+	BaseError
+}
+
+// MakeErrBadClaims helper to create ErrBadClaims
+func MakeErrBadClaims(err error) *ErrBadClaims {
+	return &ErrBadClaims{BaseError{Info: "oidc: failed to unmarshal claims: " + err.Error(), OriginalError: err}}
+}
+
+// ErrMissingExpiry is returned when a JWT doesn't have an exp claim
+type ErrMissingExpiry struct {
+	BaseError
+}
+
+// MakeErrMissingExpiry helper to create ErrMissingExpiry
+func MakeErrMissingExpiry() *ErrMissingExpiry {
+	return &ErrMissingExpiry{BaseError{Info: "oidc: jwt has no exp claim"}}
+}
+
+// ErrTokenVerification is returned when the signature or claims of a token can't be verified
+type ErrTokenVerification struct {
+	BaseError
+}
+
+// MakeErrTokenVerification helper to create ErrTokenVerification
+func MakeErrTokenVerification(err error) *ErrTokenVerification {
+	return &ErrTokenVerification{BaseError{Info: "token verification failed: " + err.Error(), OriginalError: err}}
+}
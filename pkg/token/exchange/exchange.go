@@ -0,0 +1,293 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package exchange
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/internal/flight"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+	tokenerrors "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/errors"
+	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
+)
+
+const (
+	// GrantTypeTokenExchange the grant type of a token exchange request, see RFC 8693 section 2.1
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	// TokenTypeAccessToken the token type of the subject token and of the token asked for
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// Assert that Exchanger implements common.TenantTokenSource
+var _ common.TenantTokenSource = (*Exchanger)(nil)
+
+// TokenResponse the response to a token exchange request, see RFC 8693 section 2.2.1
+type TokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	Scope           string `json:"scope"`
+}
+
+// Exchanger exchanges the tokens of a base common.TokenSource, e.g. a serviceclient.Handler, for tokens
+// scoped to other tenants.  One token is cached per tenant, the tokens of tenants that are about to expire
+// are dropped when a token for a new tenant is exchanged so that the cache only grows with the number of
+// tenants in use.
+type Exchanger struct {
+	base          common.TokenSource
+	iamServiceURL string
+	httpClient    tokenutil.HttpClient
+	retryPolicy   tokenutil.RetryPolicy
+	scope         string
+	audience      string
+
+	// mu guards tenants, and the tenantTokens in it
+	mu      sync.Mutex
+	tenants map[string]*tenantToken
+}
+
+// tenantToken the cached token for a tenant, and the in-progress exchange for the tenant if there is one.
+// The exchange is shared by every caller that needs a new token for the tenant, so that concurrent callers
+// result in a single request to IAM.
+type tenantToken struct {
+	token  *common.Token
+	flight *flight.Flight
+}
+
+// Opt - function option definition
+type Opt func(e *Exchanger)
+
+// WithHTTPClient override the http client used for requests to IAM
+func WithHTTPClient(c tokenutil.HttpClient) Opt {
+	return func(e *Exchanger) {
+		e.httpClient = c
+	}
+}
+
+// WithRetryPolicy override the RetryPolicy used for requests to IAM
+func WithRetryPolicy(p tokenutil.RetryPolicy) Opt {
+	return func(e *Exchanger) {
+		e.retryPolicy = p
+	}
+}
+
+// WithScope sets the scope asked for, scope is a space or comma separated list of scopes
+func WithScope(scope string) Opt {
+	return func(e *Exchanger) {
+		e.scope = tokenutil.NormaliseScope(scope)
+	}
+}
+
+// WithAudience sets the audience asked for
+func WithAudience(audience string) Opt {
+	return func(e *Exchanger) {
+		e.audience = audience
+	}
+}
+
+// New creates an Exchanger that exchanges the tokens of base using the IAM at iamServiceURL
+func New(base common.TokenSource, iamServiceURL string, opts ...Opt) *Exchanger {
+	e := &Exchanger{
+		base:          base,
+		iamServiceURL: strings.TrimRight(iamServiceURL, "/"),
+		httpClient:    &http.Client{Timeout: 10 * time.Second},
+		retryPolicy:   tokenutil.DefaultRetryPolicy(),
+		tenants:       make(map[string]*tenantToken),
+	}
+
+	// run overrides
+	for _, opt := range opts {
+		if opt != nil {
+			opt(e)
+		}
+	}
+
+	return e
+}
+
+// TenantToken returns the cached token for tenantID, exchanging a token from the base TokenSource for a
+// new one if there isn't one or if its time-to-expiry is <= common.TimeToTokenExpiry.  Concurrent callers
+// that need a new token for the same tenant share a single exchange.  If ctx is cancelled the caller stops
+// waiting, the exchange is only cancelled once every caller waiting on it has given up.
+func (e *Exchanger) TenantToken(ctx context.Context, tenantID string) (*common.Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if tenantID == "" {
+		return nil, fmt.Errorf("token exchange: a tenant id must be specified")
+	}
+
+	e.mu.Lock()
+	tt, ok := e.tenants[tenantID]
+	if !ok {
+		e.prune()
+		tt = &tenantToken{}
+		e.tenants[tenantID] = tt
+	}
+
+	if valid(tt.token) {
+		token := *tt.token
+		e.mu.Unlock()
+
+		return &token, nil
+	}
+
+	f := tt.flight
+	if f == nil {
+		f = e.startFlight(tt, tenantID)
+	}
+	f.Join()
+	e.mu.Unlock()
+
+	val, err := f.Wait(ctx, func() {
+		if tt.flight == f {
+			tt.flight = nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	token := *val.(*common.Token)
+
+	return &token, nil
+}
+
+// startFlight starts an exchange for tenantID whose result is stored in tt, e.mu must be held
+func (e *Exchanger) startFlight(tt *tenantToken, tenantID string) *flight.Flight {
+	ctx, cancel := context.WithCancel(context.Background())
+	tt.flight = flight.Start(ctx, cancel, &e.mu,
+		func(ctx context.Context) (interface{}, error) {
+			return e.exchange(ctx, tenantID)
+		},
+		func(f *flight.Flight, val interface{}, err error) (interface{}, error) {
+			if tt.flight == f {
+				tt.flight = nil
+				if err == nil {
+					tt.token = val.(*common.Token)
+				}
+			}
+
+			return val, err
+		})
+
+	return tt.flight
+}
+
+// prune drops the tenants whose tokens are about to expire and that have no exchange in progress, e.mu
+// must be held
+func (e *Exchanger) prune() {
+	for tenantID, tt := range e.tenants {
+		if tt.flight == nil && !valid(tt.token) {
+			delete(e.tenants, tenantID)
+		}
+	}
+}
+
+// valid returns true if token's time-to-expiry is > common.TimeToTokenExpiry
+func valid(token *common.Token) bool {
+	return token != nil && time.Until(token.Expiry) > common.TimeToTokenExpiry*time.Second
+}
+
+// TokenSource returns a common.TokenSource for the tokens for tenantID
+func (e *Exchanger) TokenSource(tenantID string) common.TokenSource {
+	return tenantTokenSource{e: e, tenantID: tenantID}
+}
+
+type tenantTokenSource struct {
+	e        *Exchanger
+	tenantID string
+}
+
+func (t tenantTokenSource) Token(ctx context.Context) (*common.Token, error) {
+	return t.e.TenantToken(ctx, t.tenantID)
+}
+
+// exchange exchanges a token from the base TokenSource for one scoped to tenantID
+func (e *Exchanger) exchange(ctx context.Context, tenantID string) (*common.Token, error) {
+	subject, err := e.base.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Add("grant_type", GrantTypeTokenExchange)
+	params.Add("subject_token", subject.AccessToken)
+	params.Add("subject_token_type", TokenTypeAccessToken)
+	params.Add("requested_token_type", TokenTypeAccessToken)
+	params.Add("tenant_id", tenantID)
+	if e.scope != "" {
+		params.Add("scope", e.scope)
+	}
+	if e.audience != "" {
+		params.Add("audience", e.audience)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/v1/token", e.iamServiceURL),
+		strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	issuedAt := time.Now()
+	resp, err := tokenutil.DoRequestWithRetries(ctx, e.httpClient, req, e.retryPolicy)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// The exchange has no client id of its own, so 401 and 403 get exchange-specific errors
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return nil, tokenerrors.MakeErrUnauthorized(fmt.Sprintf(
+			"token exchange for tenant %s rejected the token of the base token source", tenantID))
+	case http.StatusForbidden:
+		return nil, tokenerrors.MakeErrForbidden(fmt.Sprintf("token exchange for tenant %s", tenantID))
+	}
+	if err = tokenutil.ManageHTTPErrorCodes(resp, ""); err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tr TokenResponse
+	if err = json.Unmarshal(body, &tr); err != nil {
+		return nil, err
+	}
+
+	token := &common.Token{
+		AccessToken: tr.AccessToken,
+		TokenType:   tr.TokenType,
+		Scope:       tr.Scope,
+	}
+	if token.TokenType == "" || strings.EqualFold(token.TokenType, "N_A") {
+		token.TokenType = common.TokenTypeBearer
+	}
+
+	// The exchanged token is decoded to find its expiry if IAM didn't return expires_in
+	if tr.ExpiresIn > 0 {
+		token.Expiry = issuedAt.Add(time.Duration(tr.ExpiresIn) * time.Second)
+	} else {
+		details, err := tokenutil.DecodeAccessToken(tr.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		token.Expiry = time.Unix(details.Expiry, 0)
+	}
+
+	return token, nil
+}
@@ -0,0 +1,274 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package exchange
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/internal/iamtest"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+	tokenerrors "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/errors"
+	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
+)
+
+const testSubjectToken = "base-token"
+
+// baseTokenSource a common.TokenSource that returns a fixed token or error
+type baseTokenSource struct {
+	err error
+}
+
+func (b baseTokenSource) Token(_ context.Context) (*common.Token, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	return &common.Token{AccessToken: testSubjectToken, TokenType: common.TokenTypeBearer}, nil
+}
+
+// blockingTokenSource a common.TokenSource that returns its token once release is closed, or the context's
+// error if the context is done first
+type blockingTokenSource struct {
+	release chan struct{}
+}
+
+func (b blockingTokenSource) Token(ctx context.Context) (*common.Token, error) {
+	select {
+	case <-b.release:
+		return baseTokenSource{}.Token(ctx)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// exchangeIAM is a local fake of the IAM token exchange endpoint
+type exchangeIAM struct {
+	iamtest.Recorder
+	server    *httptest.Server
+	expiresIn int
+}
+
+func newExchangeIAM(t *testing.T, expiresIn int) *exchangeIAM {
+	t.Helper()
+	f := &exchangeIAM{expiresIn: expiresIn}
+
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/token" || r.PostFormValue("subject_token") != testSubjectToken {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		tenantID := r.PostFormValue("tenant_id")
+		switch tenantID {
+		case "forbidden":
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		case "unauthorized":
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		f.Record(r.PostForm)
+		n := f.Count("tenant_id", tenantID)
+
+		// Slow the response so that concurrent callers overlap
+		time.Sleep(10 * time.Millisecond)
+		_, _ = fmt.Fprintf(w, `{"access_token":"%s-%d","issued_token_type":%q,"token_type":"N_A","expires_in":%d}`,
+			tenantID, n, TokenTypeAccessToken, f.expiresIn)
+	}))
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func TestExchangerTenantToken(t *testing.T) {
+	t.Parallel()
+	iam := newExchangeIAM(t, 3600)
+	ex := New(baseTokenSource{}, iam.server.URL+"/", WithScope("hpe-tenant,read"), WithAudience("metal"))
+
+	for i := 0; i < 3; i++ {
+		for _, tenantID := range []string{"tenant-a", "tenant-b"} {
+			token, err := ex.TenantToken(context.Background(), tenantID)
+			require.NoError(t, err)
+			assert.Equal(t, tenantID+"-1", token.AccessToken)
+			assert.Equal(t, common.TokenTypeBearer, token.TokenType)
+			assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expiry, 10*time.Second)
+		}
+	}
+
+	assert.Equal(t, 1, iam.Count("tenant_id", "tenant-a"))
+	assert.Equal(t, 1, iam.Count("tenant_id", "tenant-b"))
+
+	requests := iam.Requests()
+	require.NotEmpty(t, requests)
+	assert.Equal(t, url.Values{
+		"grant_type":           {GrantTypeTokenExchange},
+		"subject_token":        {testSubjectToken},
+		"subject_token_type":   {TokenTypeAccessToken},
+		"requested_token_type": {TokenTypeAccessToken},
+		"tenant_id":            {"tenant-a"},
+		"scope":                {"hpe-tenant read"},
+		"audience":             {"metal"},
+	}, requests[0])
+}
+
+func TestExchangerTenantTokenExpiring(t *testing.T) {
+	t.Parallel()
+	// Tokens expire within common.TimeToTokenExpiry so every call exchanges a new token
+	iam := newExchangeIAM(t, 60)
+	ex := New(baseTokenSource{}, iam.server.URL)
+
+	for i := 1; i <= 3; i++ {
+		token, err := ex.TokenSource("tenant-a").Token(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("tenant-a-%d", i), token.AccessToken)
+	}
+}
+
+func TestExchangerTenantTokenConcurrent(t *testing.T) {
+	t.Parallel()
+	iam := newExchangeIAM(t, 3600)
+	ex := New(baseTokenSource{}, iam.server.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := ex.TenantToken(context.Background(), "tenant-a")
+			assert.NoError(t, err)
+			assert.Equal(t, "tenant-a-1", token.AccessToken)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, iam.Count("tenant_id", "tenant-a"))
+}
+
+func TestExchangerTenantTokenCancel(t *testing.T) {
+	t.Parallel()
+	iam := newExchangeIAM(t, 3600)
+	base := blockingTokenSource{release: make(chan struct{})}
+	ex := New(base, iam.server.URL)
+
+	// A caller waiting on an exchange started by another caller stops waiting when its context is done
+	result := make(chan error)
+	go func() {
+		token, err := ex.TenantToken(context.Background(), "tenant-a")
+		if err == nil {
+			assert.Equal(t, "tenant-a-1", token.AccessToken)
+		}
+		result <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := ex.TenantToken(ctx, "tenant-a")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	// The exchange carries on for the other caller
+	close(base.release)
+	assert.NoError(t, <-result)
+	assert.Equal(t, 1, iam.Count("tenant_id", "tenant-a"))
+
+	// The exchange is cancelled once every caller waiting on it has given up
+	ex = New(blockingTokenSource{release: make(chan struct{})}, iam.server.URL)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = ex.TenantToken(ctx, "tenant-b")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, 0, iam.Count("tenant_id", "tenant-b"))
+}
+
+func TestExchangerPrunesTenants(t *testing.T) {
+	t.Parallel()
+	// Tokens expire within common.TimeToTokenExpiry so are dropped when another tenant is added
+	iam := newExchangeIAM(t, 60)
+	ex := New(baseTokenSource{}, iam.server.URL)
+
+	for _, tenantID := range []string{"tenant-a", "tenant-b", "tenant-c"} {
+		_, err := ex.TenantToken(context.Background(), tenantID)
+		require.NoError(t, err)
+	}
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	assert.Len(t, ex.tenants, 1)
+	assert.Contains(t, ex.tenants, "tenant-c")
+}
+
+func TestExchangerTenantTokenErrors(t *testing.T) {
+	t.Parallel()
+	iam := newExchangeIAM(t, 3600)
+	errBase := errors.New("base token error")
+
+	testcases := []struct {
+		name     string
+		base     common.TokenSource
+		tenantID string
+		check    func(t *testing.T, err error)
+	}{
+		{
+			name:     "no tenant id",
+			base:     baseTokenSource{},
+			tenantID: "",
+			check: func(t *testing.T, err error) {
+				assert.EqualError(t, err, "token exchange: a tenant id must be specified")
+			},
+		},
+		{
+			name:     "base token error",
+			base:     baseTokenSource{err: errBase},
+			tenantID: "tenant-a",
+			check: func(t *testing.T, err error) {
+				assert.Equal(t, errBase, err)
+			},
+		},
+		{
+			name:     "exchange forbidden",
+			base:     baseTokenSource{},
+			tenantID: "forbidden",
+			check: func(t *testing.T, err error) {
+				var forbidden *tokenerrors.ErrForbidden
+				assert.True(t, errors.As(err, &forbidden))
+				assert.EqualError(t, err, "Forbidden: token exchange for tenant forbidden")
+			},
+		},
+		{
+			name:     "exchange unauthorized",
+			base:     baseTokenSource{},
+			tenantID: "unauthorized",
+			check: func(t *testing.T, err error) {
+				var unauthorized *tokenerrors.ErrUnauthorized
+				assert.True(t, errors.As(err, &unauthorized))
+				assert.EqualError(t, err, "Unauthorized access: token exchange for tenant unauthorized rejected "+
+					"the token of the base token source")
+			},
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ex := New(tc.base, iam.server.URL, WithRetryPolicy(tokenutil.RetryPolicy{MaxAttempts: 1}))
+			token, err := ex.TenantToken(context.Background(), tc.tenantID)
+			assert.Nil(t, token)
+			tc.check(t, err)
+		})
+	}
+}
@@ -2,10 +2,15 @@ package httpclient
 
 import (
 	"context"
+	stderrors "errors"
+	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/errors"
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/identitytoken"
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/issuertoken"
 	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
@@ -16,32 +21,133 @@ type Client struct {
 	identityServiceURL  string
 	httpClient          tokenutil.HttpClient
 	vendedServiceClient bool
+	requestOpts         []tokenutil.RequestOpt
+
+	// mu guards refreshToken, the refresh token returned with the last non-API-vended token
+	mu           sync.Mutex
+	refreshToken string
+}
+
+// ClientOpt - function option definition
+type ClientOpt func(c *Client)
+
+// WithRetryPolicy override the RetryPolicy used for token requests
+func WithRetryPolicy(p tokenutil.RetryPolicy) ClientOpt {
+	return func(c *Client) {
+		c.requestOpts = append(c.requestOpts, tokenutil.WithRetryPolicy(p))
+	}
+}
+
+// WithClientAssertion authenticate with a client assertion signed by s in place of the client secret
+func WithClientAssertion(s *tokenutil.ClientAssertionSigner) ClientOpt {
+	return func(c *Client) {
+		c.requestOpts = append(c.requestOpts, tokenutil.WithClientAssertion(s))
+	}
+}
+
+// WithScope override tokenutil.DefaultScope for issuer token requests, scope is a space or comma
+// separated list of scopes
+func WithScope(scope string) ClientOpt {
+	return func(c *Client) {
+		c.requestOpts = append(c.requestOpts, tokenutil.WithScope(scope))
+	}
+}
+
+// WithAudience sets the audience asked for in issuer token requests
+func WithAudience(audience string) ClientOpt {
+	return func(c *Client) {
+		c.requestOpts = append(c.requestOpts, tokenutil.WithAudience(audience))
+	}
 }
 
 // New creates a new identity Client object
-func New(identityServiceURL string, vendedServiceClient bool, passedInToken string) *Client {
+func New(identityServiceURL string, vendedServiceClient bool, passedInToken string, opts ...ClientOpt) *Client {
 	client := &http.Client{Timeout: 10 * time.Second}
 	identityServiceURL = strings.TrimRight(identityServiceURL, "/")
-	return &Client{
+	c := &Client{
 		passedInToken:       passedInToken,
 		identityServiceURL:  identityServiceURL,
 		httpClient:          client,
 		vendedServiceClient: vendedServiceClient,
 	}
+
+	// run overrides
+	for _, opt := range opts {
+		if opt != nil {
+			opt(c)
+		}
+	}
+
+	return c
 }
 
-func (c *Client) GenerateToken(ctx context.Context, tenantID, clientID, clientSecret string) (string, error) {
+// GenerateToken generates a token using the service-client creds, or returns the passed-in token.  The
+// Expiry of a passed-in token isn't known.
+func (c *Client) GenerateToken(ctx context.Context, tenantID, clientID, clientSecret string) (*common.Token, error) {
 	// we don't have a passed-in token, so we need to actually generate a token
 	if c.passedInToken == "" {
 		if c.vendedServiceClient {
-			token, err := issuertoken.GenerateToken(ctx, tenantID, clientID, clientSecret, c.identityServiceURL, c.httpClient)
+			token, err := issuertoken.GenerateToken(ctx, tenantID, clientID, clientSecret, c.identityServiceURL, c.httpClient, c.requestOpts...)
 			return token, err
 		} else {
-			token, err := identitytoken.GenerateToken(ctx, tenantID, clientID, clientSecret, c.identityServiceURL, c.httpClient)
-			return token, err
+			return c.generateIdentityToken(ctx, tenantID, clientID, clientSecret)
 		}
 	}
 
 	// we have a passed-in token, return it
-	return c.passedInToken, nil
+	return &common.Token{AccessToken: c.passedInToken, TokenType: common.TokenTypeBearer}, nil
+}
+
+// generateIdentityToken uses the refresh token returned with the last token, if there is one, to generate
+// a token.  If IAM rejects the refresh token with invalid_grant it falls back to client credentials.
+func (c *Client) generateIdentityToken(ctx context.Context, tenantID, clientID, clientSecret string) (*common.Token, error) {
+	c.mu.Lock()
+	refreshToken := c.refreshToken
+	c.mu.Unlock()
+
+	if refreshToken != "" {
+		token, err := identitytoken.RefreshToken(ctx, tenantID, clientID, clientSecret, refreshToken, c.identityServiceURL, c.httpClient, c.requestOpts...)
+		if err == nil {
+			c.storeRefreshToken(refreshToken, token)
+
+			return token, nil
+		}
+
+		var invalidGrant *errors.ErrInvalidGrant
+		if !stderrors.As(err, &invalidGrant) {
+			return nil, err
+		}
+
+		log.Printf("[DEBUG] refresh token rejected, falling back to client credentials: %s", err)
+		c.storeRefreshToken(refreshToken, nil)
+		refreshToken = ""
+	}
+
+	token, err := identitytoken.GenerateToken(ctx, tenantID, clientID, clientSecret, c.identityServiceURL, c.httpClient, c.requestOpts...)
+	if err != nil {
+		return nil, err
+	}
+	c.storeRefreshToken(refreshToken, token)
+
+	return token, nil
+}
+
+// storeRefreshToken replaces the refresh token that was used, previous, with the one returned with token.  If
+// no refresh token was returned then one that was used successfully is kept, and one that was rejected, which is
+// signalled by a nil token, is dropped.
+func (c *Client) storeRefreshToken(previous string, token *common.Token) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Another call has already replaced the refresh token
+	if c.refreshToken != previous {
+		return
+	}
+
+	switch {
+	case token == nil:
+		c.refreshToken = ""
+	case token.RefreshToken != "":
+		c.refreshToken = token.RefreshToken
+	}
 }
@@ -4,13 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/hewlettpackard/hpegl-provider-lib/internal/iamtest"
+	tokenerrors "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/errors"
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/identitytoken"
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/issuertoken"
+	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type testCaseIssuer struct {
@@ -199,9 +208,12 @@ func TestGenerateToken(t *testing.T) {
 		token, err := c.GenerateToken(tc.ctx, "", "", "")
 		if tc.err != nil {
 			assert.EqualError(t, err, tc.err.Error())
+			assert.Nil(t, token)
+
+			continue
 		}
 
-		assert.Equal(t, tc.token.AccessToken, token)
+		assert.Equal(t, tc.token.AccessToken, token.AccessToken)
 	}
 
 	// Tests for identitytoken package
@@ -213,9 +225,12 @@ func TestGenerateToken(t *testing.T) {
 		token, err := c.GenerateToken(tc.ctx, "", "", "")
 		if tc.err != nil {
 			assert.EqualError(t, err, tc.err.Error())
+			assert.Nil(t, token)
+
+			continue
 		}
 
-		assert.Equal(t, tc.token.AccessToken, token)
+		assert.Equal(t, tc.token.AccessToken, token.AccessToken)
 	}
 }
 
@@ -224,6 +239,175 @@ func TestGenerateTokenPassedInToken(t *testing.T) {
 	c := createTestClient("", "testToken", http.StatusAccepted, nil, true)
 
 	token, err := c.GenerateToken(context.Background(), "", "", "")
-	assert.Equal(t, "testToken", token)
 	assert.NoError(t, err)
+	assert.Equal(t, "testToken", token.AccessToken)
+	assert.True(t, token.Expiry.IsZero())
+}
+
+type countingHTTPClient struct {
+	statusCode int
+	calls      int
+}
+
+func (h *countingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	h.calls++
+
+	return &http.Response{StatusCode: h.statusCode, Body: &bodyReadCloser{}}, nil
+}
+
+func TestGenerateTokenRetryPolicy(t *testing.T) {
+	t.Parallel()
+	policy := tokenutil.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	for _, vended := range []bool{true, false} {
+		c := New("https://client.greenlake.hpe.com/api/iam", vended, "", WithRetryPolicy(policy))
+		httpClient := &countingHTTPClient{statusCode: http.StatusTooManyRequests}
+		c.httpClient = httpClient
+
+		_, err := c.GenerateToken(context.Background(), "", "", "")
+		assert.EqualError(t, err, "Unexpected status code 429")
+		assert.Equal(t, 3, httpClient.calls)
+	}
+}
+
+// refreshingIAM is a local fake of the non-API-vended IAM token endpoint that issues a new refresh token
+// with every token
+type refreshingIAM struct {
+	iamtest.Recorder
+	server *httptest.Server
+
+	mu     sync.Mutex
+	issued int
+	// refreshStatus, if set, is the status code returned for refresh_token grants
+	refreshStatus int
+	refreshBody   string
+}
+
+func newRefreshingIAM(t *testing.T) *refreshingIAM {
+	t.Helper()
+	f := &refreshingIAM{}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input identitytoken.GenerateTokenInput
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		f.Record(url.Values{
+			"tenant_id":     {input.TenantID},
+			"client_id":     {input.ClientID},
+			"client_secret": {input.ClientSecret},
+			"grant_type":    {input.GrantType},
+			"refresh_token": {input.RefreshToken},
+		})
+
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if input.GrantType == "refresh_token" {
+			if f.refreshStatus != 0 {
+				w.WriteHeader(f.refreshStatus)
+				_, _ = w.Write([]byte(f.refreshBody))
+
+				return
+			}
+			if input.RefreshToken != fmt.Sprintf("refresh-%d", f.issued) {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_grant","error_description":"unknown refresh token"}`))
+
+				return
+			}
+		}
+
+		f.issued++
+		_ = json.NewEncoder(w).Encode(identitytoken.TokenResponse{
+			TokenType:    "Bearer",
+			AccessToken:  fmt.Sprintf("access-%d", f.issued),
+			RefreshToken: fmt.Sprintf("refresh-%d", f.issued),
+			ExpiresIn:    3600,
+		})
+	}))
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func TestGenerateTokenRefreshTokenGrant(t *testing.T) {
+	t.Parallel()
+	iam := newRefreshingIAM(t)
+	c := New(iam.server.URL, false, "")
+
+	for i := 1; i <= 3; i++ {
+		token, err := c.GenerateToken(context.Background(), "tenant", "client", "secret")
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("access-%d", i), token.AccessToken)
+		assert.Equal(t, fmt.Sprintf("refresh-%d", i), token.RefreshToken)
+	}
+
+	assert.Equal(t, []string{"client_credentials", "refresh_token", "refresh_token"}, iam.Values("grant_type"))
+	assert.Equal(t, []string{"", "refresh-1", "refresh-2"}, iam.Values("refresh_token"))
+	for _, params := range iam.Requests() {
+		assert.Equal(t, "tenant", params.Get("tenant_id"))
+		assert.Equal(t, "client", params.Get("client_id"))
+		assert.Equal(t, "secret", params.Get("client_secret"))
+	}
+}
+
+func TestGenerateTokenRefreshTokenInvalidGrant(t *testing.T) {
+	t.Parallel()
+	iam := newRefreshingIAM(t)
+	c := New(iam.server.URL, false, "")
+
+	_, err := c.GenerateToken(context.Background(), "tenant", "client", "secret")
+	require.NoError(t, err)
+
+	// Revoke the refresh token
+	c.mu.Lock()
+	c.refreshToken = "revoked"
+	c.mu.Unlock()
+
+	token, err := c.GenerateToken(context.Background(), "tenant", "client", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "access-2", token.AccessToken)
+
+	// The refresh token returned by the fallback is used next time
+	token, err = c.GenerateToken(context.Background(), "tenant", "client", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "access-3", token.AccessToken)
+
+	assert.Equal(t, []string{"client_credentials", "refresh_token", "client_credentials", "refresh_token"},
+		iam.Values("grant_type"))
+	assert.Equal(t, []string{"", "revoked", "", "refresh-2"}, iam.Values("refresh_token"))
+}
+
+func TestGenerateTokenRefreshTokenError(t *testing.T) {
+	t.Parallel()
+	iam := newRefreshingIAM(t)
+	c := New(iam.server.URL, false, "", WithRetryPolicy(tokenutil.RetryPolicy{MaxAttempts: 1}))
+
+	_, err := c.GenerateToken(context.Background(), "tenant", "client", "secret")
+	require.NoError(t, err)
+
+	// Errors other than invalid_grant are returned without falling back to client credentials
+	iam.mu.Lock()
+	iam.refreshStatus = http.StatusBadRequest
+	iam.refreshBody = `{"error":"invalid_request"}`
+	iam.mu.Unlock()
+
+	_, err = c.GenerateToken(context.Background(), "tenant", "client", "secret")
+	var badRequest *tokenerrors.ErrBadRequest
+	assert.True(t, errors.As(err, &badRequest))
+
+	// The refresh token is kept
+	iam.mu.Lock()
+	iam.refreshStatus = 0
+	iam.mu.Unlock()
+
+	token, err := c.GenerateToken(context.Background(), "tenant", "client", "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "access-2", token.AccessToken)
+
+	assert.Equal(t, []string{"client_credentials", "refresh_token", "refresh_token"}, iam.Values("grant_type"))
+	assert.Equal(t, []string{"", "refresh-1", "refresh-1"}, iam.Values("refresh_token"))
 }
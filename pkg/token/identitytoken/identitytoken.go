@@ -9,18 +9,20 @@ import (
 	"strings"
 	"time"
 
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
 	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
 )
 
-const (
-	retryLimit = 3
-)
-
 type GenerateTokenInput struct {
 	TenantID     string `json:"tenant_id"`
 	ClientID     string `json:"client_id"`
-	ClientSecret string `json:"client_secret"`
+	ClientSecret string `json:"client_secret,omitempty"`
 	GrantType    string `json:"grant_type"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// ClientAssertionType and ClientAssertion are set in place of ClientSecret if the client
+	// authenticates with a private key
+	ClientAssertionType string `json:"client_assertion_type,omitempty"`
+	ClientAssertion     string `json:"client_assertion,omitempty"`
 }
 
 type TokenResponse struct {
@@ -33,7 +35,32 @@ type TokenResponse struct {
 	AccessTokenOnly bool      `json:"accessTokenOnly"`
 }
 
-func GenerateToken(ctx context.Context, tenantID, clientID, clientSecret string, identityServiceURL string, httpClient tokenutil.HttpClient) (string, error) {
+// Token converts the TokenResponse to a common.Token, issuedAt is the time from which expires_in is counted.
+// The expiry returned by IAM is used in preference to expires_in, the Expiry is the zero time if IAM
+// returned neither.
+func (t TokenResponse) Token(issuedAt time.Time) *common.Token {
+	token := &common.Token{
+		AccessToken:  t.AccessToken,
+		TokenType:    t.TokenType,
+		Scope:        t.Scope,
+		RefreshToken: t.RefreshToken,
+	}
+	if token.TokenType == "" {
+		token.TokenType = common.TokenTypeBearer
+	}
+
+	switch {
+	case !t.Expiry.IsZero():
+		token.Expiry = t.Expiry
+	case t.ExpiresIn > 0:
+		token.Expiry = issuedAt.Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+
+	return token
+}
+
+// GenerateToken generates a token using the client_credentials grant
+func GenerateToken(ctx context.Context, tenantID, clientID, clientSecret string, identityServiceURL string, httpClient tokenutil.HttpClient, opts ...tokenutil.RequestOpt) (*common.Token, error) {
 	params := GenerateTokenInput{
 		TenantID:     tenantID,
 		ClientID:     clientID,
@@ -41,44 +68,86 @@ func GenerateToken(ctx context.Context, tenantID, clientID, clientSecret string,
 		GrantType:    "client_credentials",
 	}
 
-	url := fmt.Sprintf("%s/v1/token", identityServiceURL)
+	return requestToken(ctx, params, identityServiceURL, httpClient, opts...)
+}
 
-	b, err := json.Marshal(params)
-	if err != nil {
-		return "", err
+// RefreshToken generates a token using the refresh_token grant.  If IAM rejects the refresh token an
+// errors.ErrInvalidGrant is returned, the caller should then fall back to GenerateToken.
+func RefreshToken(ctx context.Context, tenantID, clientID, clientSecret, refreshToken string, identityServiceURL string, httpClient tokenutil.HttpClient, opts ...tokenutil.RequestOpt) (*common.Token, error) {
+	params := GenerateTokenInput{
+		TenantID:     tenantID,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		GrantType:    "refresh_token",
+		RefreshToken: refreshToken,
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(string(b)))
+	return requestToken(ctx, params, identityServiceURL, httpClient, opts...)
+}
 
-	if err != nil {
-		return "", err
+func requestToken(ctx context.Context, params GenerateTokenInput, identityServiceURL string, httpClient tokenutil.HttpClient, opts ...tokenutil.RequestOpt) (*common.Token, error) {
+	options := tokenutil.NewRequestOptions(opts...)
+
+	url := fmt.Sprintf("%s/v1/token", identityServiceURL)
+
+	// The request is built for every attempt so that each one carries a freshly signed client assertion,
+	// IAM rejects an assertion whose jti it has already seen
+	newRequest := func() (*http.Request, error) {
+		params := params
+		if options.ClientAssertion != nil {
+			assertion, err := options.ClientAssertion.Assertion(params.ClientID, url)
+			if err != nil {
+				return nil, err
+			}
+			params.ClientSecret = ""
+			params.ClientAssertionType = tokenutil.ClientAssertionType
+			params.ClientAssertion = assertion
+		}
+
+		b, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(string(b)))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		return req, nil
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := tokenutil.DoRetries(func() (*http.Response, error) {
+	issuedAt := time.Now()
+	resp, err := tokenutil.DoRetries(ctx, func() (*http.Response, error) {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
 		return httpClient.Do(req)
-	}, retryLimit)
+	}, options.RetryPolicy)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	err = tokenutil.ManageHTTPErrorCodes(resp, clientID)
+	err = tokenutil.ManageHTTPErrorCodes(resp, params.ClientID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var token TokenResponse
 
 	err = json.Unmarshal(body, &token)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return token.AccessToken, nil
+	return token.Token(issuedAt), nil
 }
@@ -0,0 +1,258 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package identitytoken
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	stderrors "errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/errors"
+	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
+)
+
+func TestGenerateTokenRetryResendsBody(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		attempt := len(bodies)
+		mu.Unlock()
+
+		if attempt < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = w.Write([]byte(`{"error":"slow down"}`))
+
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	policy := tokenutil.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	token, err := GenerateToken(context.Background(), "tenant", "client", "secret", server.URL, server.Client(),
+		tokenutil.WithRetryPolicy(policy))
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", token.AccessToken)
+
+	require.Len(t, bodies, 3)
+	var input GenerateTokenInput
+	require.NoError(t, json.Unmarshal([]byte(bodies[0]), &input))
+	assert.Equal(t, GenerateTokenInput{
+		TenantID:     "tenant",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		GrantType:    "client_credentials",
+	}, input)
+	for _, body := range bodies[1:] {
+		assert.Equal(t, bodies[0], body)
+	}
+}
+
+func TestTokenResponseToken(t *testing.T) {
+	t.Parallel()
+	issuedAt := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	expiry := issuedAt.Add(30 * time.Minute)
+	testcases := []struct {
+		name     string
+		response TokenResponse
+		want     *common.Token
+	}{
+		{
+			name: "expires_in",
+			response: TokenResponse{AccessToken: "access-token", TokenType: "Bearer", ExpiresIn: 3600,
+				Scope: "hpe-tenant", RefreshToken: "refresh-token"},
+			want: &common.Token{
+				AccessToken:  "access-token",
+				TokenType:    "Bearer",
+				Expiry:       issuedAt.Add(time.Hour),
+				Scope:        "hpe-tenant",
+				RefreshToken: "refresh-token",
+			},
+		},
+		{
+			name:     "expiry preferred to expires_in",
+			response: TokenResponse{AccessToken: "access-token", TokenType: "Bearer", ExpiresIn: 3600, Expiry: expiry},
+			want:     &common.Token{AccessToken: "access-token", TokenType: "Bearer", Expiry: expiry},
+		},
+		{
+			name:     "no expiry or token_type",
+			response: TokenResponse{AccessToken: "access-token"},
+			want:     &common.Token{AccessToken: "access-token", TokenType: common.TokenTypeBearer},
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, tc.response.Token(issuedAt))
+		})
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	t.Parallel()
+	testcases := []struct {
+		name       string
+		statusCode int
+		response   string
+		wantToken  string
+		check      func(err error) bool
+	}{
+		{
+			name:       "success",
+			statusCode: http.StatusOK,
+			response:   `{"access_token":"access-token","refresh_token":"new-refresh-token","expires_in":3600}`,
+			wantToken:  "access-token",
+		},
+		{
+			name:       "invalid_grant",
+			statusCode: http.StatusBadRequest,
+			response:   `{"error":"invalid_grant"}`,
+			check:      func(err error) bool { var e *errors.ErrInvalidGrant; return stderrors.As(err, &e) },
+		},
+		{
+			name:       "other bad request",
+			statusCode: http.StatusBadRequest,
+			response:   `{"error":"invalid_request"}`,
+			check:      func(err error) bool { var e *errors.ErrBadRequest; return stderrors.As(err, &e) },
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var input GenerateTokenInput
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewDecoder(r.Body).Decode(&input)
+				w.WriteHeader(tc.statusCode)
+				_, _ = w.Write([]byte(tc.response))
+			}))
+			defer server.Close()
+
+			token, err := RefreshToken(context.Background(), "tenant", "client", "secret", "refresh-token",
+				server.URL, server.Client())
+			assert.Equal(t, GenerateTokenInput{
+				TenantID:     "tenant",
+				ClientID:     "client",
+				ClientSecret: "secret",
+				GrantType:    "refresh_token",
+				RefreshToken: "refresh-token",
+			}, input)
+
+			if tc.check != nil {
+				assert.True(t, tc.check(err))
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantToken, token.AccessToken)
+			assert.Equal(t, "new-refresh-token", token.RefreshToken)
+		})
+	}
+}
+
+func TestGenerateTokenClientAssertion(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signer, err := tokenutil.NewClientAssertionSigner(pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), "key-1")
+	require.NoError(t, err)
+
+	var input GenerateTokenInput
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewDecoder(r.Body).Decode(&input)
+		_, _ = w.Write([]byte(`{"access_token":"access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	token, err := GenerateToken(context.Background(), "tenant", "client", "secret", server.URL, server.Client(),
+		tokenutil.WithClientAssertion(signer))
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", token.AccessToken)
+
+	assert.Equal(t, "client", input.ClientID)
+	assert.Empty(t, input.ClientSecret)
+	assert.Equal(t, tokenutil.ClientAssertionType, input.ClientAssertionType)
+
+	tok, err := jwt.ParseSigned(input.ClientAssertion)
+	require.NoError(t, err)
+	var claims jwt.Claims
+	require.NoError(t, tok.Claims(&key.PublicKey, &claims))
+	assert.NoError(t, claims.Validate(jwt.Expected{
+		Issuer:   "client",
+		Audience: jwt.Audience{server.URL + "/v1/token"},
+		Time:     time.Now(),
+	}))
+}
+
+func TestGenerateTokenClientAssertionRetry(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	signer, err := tokenutil.NewClientAssertionSigner(pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), "key-1")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var input GenerateTokenInput
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&input))
+		tok, err := jwt.ParseSigned(input.ClientAssertion)
+		require.NoError(t, err)
+		var claims jwt.Claims
+		require.NoError(t, tok.Claims(&key.PublicKey, &claims))
+
+		mu.Lock()
+		ids = append(ids, claims.ID)
+		attempt := len(ids)
+		mu.Unlock()
+
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	policy := tokenutil.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+	token, err := GenerateToken(context.Background(), "tenant", "client", "secret", server.URL, server.Client(),
+		tokenutil.WithClientAssertion(signer), tokenutil.WithRetryPolicy(policy))
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", token.AccessToken)
+
+	// Each attempt carries a freshly signed assertion
+	require.Len(t, ids, 2)
+	assert.NotEmpty(t, ids[0])
+	assert.NotEqual(t, ids[0], ids[1])
+}
@@ -6,16 +6,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
-	"net/url"
+	netURL "net/url"
 	"strings"
+	"time"
 
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
 	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
 )
 
-const (
-	retryLimit = 3
-)
-
 type TokenResponse struct {
 	TokenType   string `json:"token_type"`
 	ExpiresIn   int    `json:"expires_in"`
@@ -23,44 +21,88 @@ type TokenResponse struct {
 	Scope       string `json:"scope"`
 }
 
-func GenerateToken(ctx context.Context, tenantID, clientID, clientSecret string, identityServiceURL string, httpClient tokenutil.HttpClient) (string, error) {
-	params := url.Values{}
-	params.Add("client_id", clientID)
-	params.Add("client_secret", clientSecret)
-	params.Add("grant_type", "client_credentials")
-	params.Add("scope", "hpe-tenant")
+// Token converts the TokenResponse to a common.Token, issuedAt is the time from which expires_in is counted.
+// The Expiry is the zero time if IAM didn't return expires_in.
+func (t TokenResponse) Token(issuedAt time.Time) *common.Token {
+	token := &common.Token{
+		AccessToken: t.AccessToken,
+		TokenType:   t.TokenType,
+		Scope:       t.Scope,
+	}
+	if token.TokenType == "" {
+		token.TokenType = common.TokenTypeBearer
+	}
+	if t.ExpiresIn > 0 {
+		token.Expiry = issuedAt.Add(time.Duration(t.ExpiresIn) * time.Second)
+	}
+
+	return token
+}
+
+func GenerateToken(ctx context.Context, tenantID, clientID, clientSecret string, identityServiceURL string, httpClient tokenutil.HttpClient, opts ...tokenutil.RequestOpt) (*common.Token, error) {
+	options := tokenutil.NewRequestOptions(opts...)
 
 	url := fmt.Sprintf("%s/v1/token", identityServiceURL)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(params.Encode()))
-	if err != nil {
-		return "", err
+
+	// The request is built for every attempt so that each one carries a freshly signed client assertion,
+	// IAM rejects an assertion whose jti it has already seen
+	newRequest := func() (*http.Request, error) {
+		params := netURL.Values{}
+		params.Add("client_id", clientID)
+		if options.ClientAssertion != nil {
+			assertion, err := options.ClientAssertion.Assertion(clientID, url)
+			if err != nil {
+				return nil, err
+			}
+			params.Add("client_assertion_type", tokenutil.ClientAssertionType)
+			params.Add("client_assertion", assertion)
+		} else {
+			params.Add("client_secret", clientSecret)
+		}
+		params.Add("grant_type", "client_credentials")
+		params.Add("scope", options.Scope)
+		if options.Audience != "" {
+			params.Add("audience", options.Audience)
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(params.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		return req, nil
 	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := tokenutil.DoRetries(func() (*http.Response, error) {
+	issuedAt := time.Now()
+	resp, err := tokenutil.DoRetries(ctx, func() (*http.Response, error) {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
 		return httpClient.Do(req)
-	}, retryLimit)
+	}, options.RetryPolicy)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	err = tokenutil.ManageHTTPErrorCodes(resp, clientID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var token TokenResponse
 
 	err = json.Unmarshal(body, &token)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return token.AccessToken, nil
+	return token.Token(issuedAt), nil
 }
@@ -0,0 +1,230 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package issuertoken
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
+)
+
+func TestGenerateTokenRetryResendsBody(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		attempt := len(bodies)
+		mu.Unlock()
+
+		if attempt < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(`{"error":"unavailable"}`))
+
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	policy := tokenutil.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	token, err := GenerateToken(context.Background(), "tenant", "client", "secret", server.URL, server.Client(),
+		tokenutil.WithRetryPolicy(policy))
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", token.AccessToken)
+
+	require.Len(t, bodies, 3)
+	values, err := url.ParseQuery(bodies[0])
+	require.NoError(t, err)
+	assert.Equal(t, "client", values.Get("client_id"))
+	assert.Equal(t, "secret", values.Get("client_secret"))
+	assert.Equal(t, "client_credentials", values.Get("grant_type"))
+	for _, body := range bodies[1:] {
+		assert.Equal(t, bodies[0], body)
+	}
+}
+
+func TestTokenResponseToken(t *testing.T) {
+	t.Parallel()
+	issuedAt := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	testcases := []struct {
+		name     string
+		response TokenResponse
+		want     *common.Token
+	}{
+		{
+			name:     "expires_in",
+			response: TokenResponse{AccessToken: "access-token", TokenType: "Bearer", ExpiresIn: 3600, Scope: "hpe-tenant"},
+			want: &common.Token{
+				AccessToken: "access-token",
+				TokenType:   "Bearer",
+				Expiry:      issuedAt.Add(time.Hour),
+				Scope:       "hpe-tenant",
+			},
+		},
+		{
+			name:     "no expires_in or token_type",
+			response: TokenResponse{AccessToken: "access-token"},
+			want:     &common.Token{AccessToken: "access-token", TokenType: common.TokenTypeBearer},
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, tc.want, tc.response.Token(issuedAt))
+		})
+	}
+}
+
+func TestGenerateTokenClientAssertion(t *testing.T) {
+	t.Parallel()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	signer, err := tokenutil.NewClientAssertionSigner(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), "")
+	require.NoError(t, err)
+
+	var values url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		values = r.PostForm
+		_, _ = w.Write([]byte(`{"access_token":"access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	token, err := GenerateToken(context.Background(), "tenant", "client", "secret", server.URL, server.Client(),
+		tokenutil.WithClientAssertion(signer))
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", token.AccessToken)
+
+	assert.Equal(t, "client", values.Get("client_id"))
+	assert.Empty(t, values.Get("client_secret"))
+	assert.Equal(t, tokenutil.ClientAssertionType, values.Get("client_assertion_type"))
+
+	tok, err := jwt.ParseSigned(values.Get("client_assertion"))
+	require.NoError(t, err)
+	var claims jwt.Claims
+	require.NoError(t, tok.Claims(&key.PublicKey, &claims))
+	assert.NoError(t, claims.Validate(jwt.Expected{
+		Issuer:   "client",
+		Subject:  "client",
+		Audience: jwt.Audience{server.URL + "/v1/token"},
+		Time:     time.Now(),
+	}))
+}
+
+func TestGenerateTokenScopeAudience(t *testing.T) {
+	t.Parallel()
+	testcases := []struct {
+		name         string
+		opts         []tokenutil.RequestOpt
+		wantScope    string
+		wantAudience string
+	}{
+		{
+			name:      "default scope",
+			wantScope: tokenutil.DefaultScope,
+		},
+		{
+			name:         "scope and audience",
+			opts:         []tokenutil.RequestOpt{tokenutil.WithScope("hpe-tenant, caas.read"), tokenutil.WithAudience("api://caas")},
+			wantScope:    "hpe-tenant caas.read",
+			wantAudience: "api://caas",
+		},
+		{
+			name:      "empty scope",
+			opts:      []tokenutil.RequestOpt{tokenutil.WithScope("")},
+			wantScope: tokenutil.DefaultScope,
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			var values url.Values
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.NoError(t, r.ParseForm())
+				values = r.PostForm
+				_, _ = w.Write([]byte(`{"access_token":"access-token","token_type":"Bearer","expires_in":3600}`))
+			}))
+			defer server.Close()
+
+			_, err := GenerateToken(context.Background(), "tenant", "client", "secret", server.URL, server.Client(), tc.opts...)
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantScope, values.Get("scope"))
+			assert.Equal(t, tc.wantAudience, values.Get("audience"))
+			_, hasAudience := values["audience"]
+			assert.Equal(t, tc.wantAudience != "", hasAudience)
+		})
+	}
+}
+
+func TestGenerateTokenClientAssertionRetry(t *testing.T) {
+	t.Parallel()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	signer, err := tokenutil.NewClientAssertionSigner(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), "")
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		tok, err := jwt.ParseSigned(r.PostForm.Get("client_assertion"))
+		require.NoError(t, err)
+		var claims jwt.Claims
+		require.NoError(t, tok.Claims(&key.PublicKey, &claims))
+
+		mu.Lock()
+		ids = append(ids, claims.ID)
+		attempt := len(ids)
+		mu.Unlock()
+
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"access-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	policy := tokenutil.RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+	token, err := GenerateToken(context.Background(), "tenant", "client", "secret", server.URL, server.Client(),
+		tokenutil.WithClientAssertion(signer), tokenutil.WithRetryPolicy(policy))
+	require.NoError(t, err)
+	assert.Equal(t, "access-token", token.AccessToken)
+
+	// Each attempt carries a freshly signed assertion
+	require.Len(t, ids, 2)
+	assert.NotEmpty(t, ids[0])
+	assert.NotEqual(t, ids[0], ids[1])
+}
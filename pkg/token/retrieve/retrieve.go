@@ -4,6 +4,7 @@ package retrieve
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
 )
@@ -11,23 +12,70 @@ import (
 // TokenRetrieveFuncCtx type of function to retrieve a token passing-in a context
 type TokenRetrieveFuncCtx func(ctx context.Context) (string, error)
 
+// TenantTokenRetrieveFuncCtx type of function to retrieve a token for a tenant passing-in a context
+type TenantTokenRetrieveFuncCtx func(ctx context.Context, tenantID string) (string, error)
+
 // NewTokenRetrieveFunc takes a common.TokenChannelInterface as an input and returns a
 // TokenRetrieveFuncCtx.  Exit from loop if a token is received on resCh, or if the
-// context passed-in is cancelled.  On cancellation of context a signal is sent
-// on exitCh to tell the token Handler retrieve thread to exit
+// context passed-in is cancelled.  On cancellation of context ctx.Err() is returned, only
+// that caller's wait is abandoned and the function can continue to be used by other callers.
+// The token Handler retrieve thread is stopped by the Handler's own shutdown API.
+// If the token Handler also implements common.TokenSource then NewTokenSourceRetrieveFunc is used
+// and the channels are never created.
 func NewTokenRetrieveFunc(channelInterface common.TokenChannelInterface) TokenRetrieveFuncCtx {
-	resCh, exitCh := channelInterface.TokenChannels()
+	if ts, ok := channelInterface.(common.TokenSource); ok {
+		return NewTokenSourceRetrieveFunc(ts)
+	}
 
+	return NewTokenSourceRetrieveFunc(common.NewChannelTokenSource(channelInterface))
+}
+
+// NewTokenSourceRetrieveFunc takes a common.TokenSource as an input and returns a
+// TokenRetrieveFuncCtx which returns the access token from the TokenSource
+func NewTokenSourceRetrieveFunc(ts common.TokenSource) TokenRetrieveFuncCtx {
 	return func(ctx context.Context) (string, error) {
-		for {
-			select {
-			case tok := <-resCh:
-				return tok.Token, tok.Err
-			case <-ctx.Done():
-				exitCh <- 1
-
-				return "", nil
-			}
+		token, err := ts.Token(ctx)
+		if err != nil {
+			return "", err
 		}
+
+		return token.AccessToken, nil
 	}
 }
+
+// NewTenantTokenRetrieveFunc takes a common.TenantTokenSource as an input and returns a
+// TenantTokenRetrieveFuncCtx which returns the access token for a tenant from the TenantTokenSource
+func NewTenantTokenRetrieveFunc(ts common.TenantTokenSource) TenantTokenRetrieveFuncCtx {
+	return func(ctx context.Context, tenantID string) (string, error) {
+		token, err := ts.TenantToken(ctx, tenantID)
+		if err != nil {
+			return "", err
+		}
+
+		return token.AccessToken, nil
+	}
+}
+
+// GetTokenRetrieveFunc returns the token retrieve function for the service serviceName from the
+// map[string]interface{} passed down to the provider code.  The function stored at the
+// common.ServiceTokenRetrieveFunctionKey for the service is returned if there is one, otherwise the
+// one stored at common.TokenRetrieveFunctionKey is returned.
+func GetTokenRetrieveFunc(meta map[string]interface{}, serviceName string) (TokenRetrieveFuncCtx, error) {
+	for _, key := range []string{common.ServiceTokenRetrieveFunctionKey(serviceName), common.TokenRetrieveFunctionKey} {
+		v, ok := meta[key]
+		if !ok {
+			continue
+		}
+
+		switch f := v.(type) {
+		case TokenRetrieveFuncCtx:
+			return f, nil
+		case func(ctx context.Context) (string, error):
+			return f, nil
+		default:
+			return nil, fmt.Errorf("value at key %s is a %T, not a token retrieve function", key, v)
+		}
+	}
+
+	return nil, fmt.Errorf("no token retrieve function found for service %s", serviceName)
+}
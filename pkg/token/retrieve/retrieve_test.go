@@ -0,0 +1,134 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package retrieve
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+)
+
+// channelHandler a token Handler that only implements common.TokenChannelInterface
+type channelHandler struct {
+	resultCh chan common.Result
+	exitCh   chan int
+}
+
+func (c *channelHandler) TokenChannels() (chan common.Result, chan int) {
+	return c.resultCh, c.exitCh
+}
+
+func TestNewTokenRetrieveFuncCancelledContext(t *testing.T) {
+	t.Parallel()
+	h := &channelHandler{
+		resultCh: make(chan common.Result),
+		exitCh:   make(chan int),
+	}
+	getToken := NewTokenRetrieveFunc(h)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	token, err := getToken(ctx)
+	assert.Equal(t, "", token)
+	assert.Equal(t, context.Canceled, err)
+
+	// The handler has not been told to exit, and the function can still be used
+	select {
+	case <-h.exitCh:
+		t.Fatal("exit signalled on cancellation of a caller's context")
+	default:
+	}
+
+	go func() {
+		h.resultCh <- common.Result{Token: "token"}
+	}()
+	token, err = getToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token)
+}
+
+func TestGetTokenRetrieveFunc(t *testing.T) {
+	t.Parallel()
+	defaultFunc := TokenRetrieveFuncCtx(func(context.Context) (string, error) { return "default", nil })
+	serviceFunc := func(context.Context) (string, error) { return "service", nil }
+
+	testcases := []struct {
+		name    string
+		meta    map[string]interface{}
+		want    string
+		wantErr string
+	}{
+		{
+			name: "service function",
+			meta: map[string]interface{}{
+				common.TokenRetrieveFunctionKey:                defaultFunc,
+				common.ServiceTokenRetrieveFunctionKey("caas"): serviceFunc,
+			},
+			want: "service",
+		},
+		{
+			name: "fall back to provider function",
+			meta: map[string]interface{}{
+				common.TokenRetrieveFunctionKey:                 defaultFunc,
+				common.ServiceTokenRetrieveFunctionKey("vmaas"): serviceFunc,
+			},
+			want: "default",
+		},
+		{
+			name:    "no function",
+			meta:    map[string]interface{}{},
+			wantErr: "no token retrieve function found for service caas",
+		},
+		{
+			name:    "wrong type",
+			meta:    map[string]interface{}{common.TokenRetrieveFunctionKey: "token"},
+			wantErr: "value at key tokenRetrieveFunc is a string, not a token retrieve function",
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			f, err := GetTokenRetrieveFunc(tc.meta, "caas")
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+
+				return
+			}
+
+			assert.NoError(t, err)
+			token, err := f(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, token)
+		})
+	}
+}
+
+// tenantHandler a token Handler that implements common.TenantTokenSource
+type tenantHandler struct{}
+
+func (tenantHandler) TenantToken(_ context.Context, tenantID string) (*common.Token, error) {
+	if tenantID == "" {
+		return nil, errors.New("no tenant")
+	}
+
+	return &common.Token{AccessToken: "token-" + tenantID}, nil
+}
+
+func TestNewTenantTokenRetrieveFunc(t *testing.T) {
+	t.Parallel()
+	getToken := NewTenantTokenRetrieveFunc(tenantHandler{})
+
+	token, err := getToken(context.Background(), "tenant-a")
+	assert.NoError(t, err)
+	assert.Equal(t, "token-tenant-a", token)
+
+	token, err = getToken(context.Background(), "")
+	assert.EqualError(t, err, "no tenant")
+	assert.Equal(t, "", token)
+}
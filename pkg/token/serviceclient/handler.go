@@ -5,38 +5,100 @@ package serviceclient
 import (
 	"context"
 	"errors"
-	"net"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 
+	"github.com/hewlettpackard/hpegl-provider-lib/internal/flight"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/registration"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/cache"
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/credentials"
 	httpc "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/httpclient"
 	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/verify"
 )
 
-const retryLimit = 3
+const (
+	// defaultRefreshFraction is the fraction of a token's lifetime after which it is refreshed in the background
+	defaultRefreshFraction = 0.8
 
-// Assert that Handler implements common.TokenChannelInterface
-var _ common.TokenChannelInterface = (*Handler)(nil)
+	// backgroundRefreshTimeout bounds the time spent on a background refresh
+	backgroundRefreshTimeout = time.Minute
+
+	// pendingResultTTL is how long a Result waits on resultCh before it is recomputed
+	pendingResultTTL = 30 * time.Second
+)
+
+// Assert that Handler implements common.TokenChannelInterface and common.TokenSource
+var (
+	_ common.TokenChannelInterface = (*Handler)(nil)
+	_ common.TokenSource           = (*Handler)(nil)
+)
 
 //go:generate mockgen -build_flags=-mod=mod -destination=../../mocks/IdentityAPI_mocks.go -package=mocks github.com/hewlettpackard/hpegl-provider-lib/pkg/token/serviceclient IdentityAPI
 type IdentityAPI interface {
-	GenerateToken(context.Context, string, string, string) (string, error)
+	GenerateToken(context.Context, string, string, string) (*common.Token, error)
+}
+
+// TokenVerifier verifies a token and returns its decoded details, verify.Verifier implements it
+type TokenVerifier interface {
+	Verify(ctx context.Context, rawToken string) (tokenutil.Token, error)
+}
+
+// TokenCache caches tokens between provider processes, cache.FileCache implements it
+type TokenCache interface {
+	Fetch(ctx context.Context, key cache.Key, current *common.Token, fetch cache.FetchFunc) (*common.Token, error)
 }
 
 // Handler the handler for service-client creds
 type Handler struct {
 	iamServiceURL       string
-	token               string
 	tenantID            string
 	clientID            string
 	clientSecret        string
 	vendedServiceClient bool
-	numRetries          int
+	passedInToken       string
+	scope               string
+	audience            string
+	refreshFraction     float64
 	client              IdentityAPI
-	resultCh            chan common.Result
-	exitCh              chan int
+	verifier            TokenVerifier
+	tokenCache          TokenCache
+	credentials         credentials.CredentialProvider
+	clientOpts          []httpc.ClientOpt
+	// privateKeyFile and privateKeyID are the user_private_key_file and user_private_key_id, if a key file is
+	// set tokens are requested with a client assertion signed by the key rather than the secret
+	privateKeyFile string
+	privateKeyID   string
+	// credentialsSet is set by WithCredentials, the CredentialProvider isn't then consulted
+	credentialsSet bool
+	// resolved is set by NewServiceHandlers so that its Handlers share the credentials resolved by the
+	// CredentialProvider
+	resolved *resolvedCredentials
+
+	// mu guards the cached token, the in-progress refresh and the background refresh state.  The refresh is
+	// shared by every caller that needs a new token, so that concurrent callers result in a single request
+	// to IAM.
+	mu           sync.Mutex
+	token        *common.Token
+	flight       *flight.Flight
+	refreshTimer *time.Timer
+	// used is set when the cached token is handed out, a background refresh is only
+	// re-armed if the previous token was used
+	used bool
+	// closed is set by Close, stopThread stops the thread serving TokenChannels
+	closed     bool
+	stopThread context.CancelFunc
+
+	// channels are only created if TokenChannels is called
+	channelsOnce sync.Once
+	resultCh     chan common.Result
+	exitCh       chan int
 }
 
 // CreateOpt - function option definition
@@ -49,21 +111,105 @@ func WithIdentityAPI(i IdentityAPI) CreateOpt {
 	}
 }
 
-// NewHandler creates a new handler and returns the common.TokenChannelInterface interface
-func NewHandler(d *schema.ResourceData, opts ...CreateOpt) (common.TokenChannelInterface, error) {
+// WithRetryPolicy override the RetryPolicy used for requests to IAM, it has no effect if
+// WithIdentityAPI is also used
+func WithRetryPolicy(p tokenutil.RetryPolicy) CreateOpt {
+	return func(h *Handler) {
+		h.clientOpts = append(h.clientOpts, httpc.WithRetryPolicy(p))
+	}
+}
+
+// WithIAMServiceURL override the iam_service_url in the provider config.  It has no effect if
+// WithIdentityAPI is also used.
+func WithIAMServiceURL(url string) CreateOpt {
+	return func(h *Handler) {
+		h.iamServiceURL = url
+	}
+}
+
+// WithCredentials override the tenant_id, user_id and user_secret in the provider config, any passed-in
+// iam_token is then ignored
+func WithCredentials(tenantID, clientID, clientSecret string) CreateOpt {
+	return func(h *Handler) {
+		h.tenantID = tenantID
+		h.clientID = clientID
+		h.clientSecret = clientSecret
+		h.passedInToken = ""
+		h.credentialsSet = true
+	}
+}
+
+// WithCredentialProvider override the CredentialProvider consulted for the tenant_id, user_id and user_secret,
+// by default this is credentials.DefaultChain
+func WithCredentialProvider(p credentials.CredentialProvider) CreateOpt {
+	return func(h *Handler) {
+		h.credentials = p
+	}
+}
+
+// WithScope override the scopes asked for, scope is a space or comma separated list of scopes.  It has
+// no effect if WithIdentityAPI is also used.
+func WithScope(scope string) CreateOpt {
+	return func(h *Handler) {
+		h.scope = scope
+	}
+}
+
+// WithAudience override the audience asked for.  It has no effect if WithIdentityAPI is also used.
+func WithAudience(audience string) CreateOpt {
+	return func(h *Handler) {
+		h.audience = audience
+	}
+}
+
+// WithVerifier override the TokenVerifier used to verify tokens, by default tokens are only verified
+// if iam_token_verify is set
+func WithVerifier(v TokenVerifier) CreateOpt {
+	return func(h *Handler) {
+		h.verifier = v
+	}
+}
+
+// WithTokenCache override the TokenCache used to share tokens between provider processes, by default tokens
+// are only cached if iam_token_cache is set
+func WithTokenCache(c TokenCache) CreateOpt {
+	return func(h *Handler) {
+		h.tokenCache = c
+	}
+}
+
+// WithRefreshFraction override the fraction of a token's lifetime after which the token is refreshed
+// in the background.  A value of 0 disables background refresh, tokens are then only refreshed
+// on demand when they are about to expire.
+func WithRefreshFraction(f float64) CreateOpt {
+	return func(h *Handler) {
+		h.refreshFraction = f
+	}
+}
+
+// NewHandler creates a new handler, which implements the common.TokenChannelInterface interface
+// The service-client credentials are resolved by the credential chain, see credentials.DefaultChain,
+// unless WithCredentials is used.  Credentials set by opts take precedence over the chain.
+// No token is generated until one is asked for.  Close should be called when the provider is torn down.
+func NewHandler(d *schema.ResourceData, opts ...CreateOpt) (*Handler, error) {
+	return NewHandlerContext(context.Background(), d, opts...)
+}
+
+// NewHandlerContext is NewHandler with a context, e.g. the provider's configure context, that is used to
+// resolve the credentials so that an exec plugin run by the credential chain is cancelled with it
+func NewHandlerContext(ctx context.Context, d *schema.ResourceData, opts ...CreateOpt) (*Handler, error) {
 	h := new(Handler)
 
 	// set Handler fields
 	h.iamServiceURL = d.Get("iam_service_url").(string)
-	h.tenantID = d.Get("tenant_id").(string)
-	h.clientID = d.Get("user_id").(string)
-	h.clientSecret = d.Get("user_secret").(string)
 	h.vendedServiceClient = d.Get("api_vended_service_client").(bool)
-
 	// get passed-in token, if present
-	passedInToken := d.Get("iam_token").(string)
-
-	h.client = httpc.New(h.iamServiceURL, h.vendedServiceClient, passedInToken)
+	h.passedInToken = d.Get("iam_token").(string)
+	h.scope = d.Get("iam_scopes").(string)
+	h.audience = d.Get("iam_audience").(string)
+	h.privateKeyFile = d.Get("user_private_key_file").(string)
+	h.privateKeyID = d.Get("user_private_key_id").(string)
+	h.refreshFraction = defaultRefreshFraction
 
 	// run overrides
 	for _, opt := range opts {
@@ -72,126 +218,523 @@ func NewHandler(d *schema.ResourceData, opts ...CreateOpt) (common.TokenChannelI
 		}
 	}
 
-	// make channels
-	h.resultCh = make(chan common.Result)
-	h.exitCh = make(chan int)
+	if !h.credentialsSet {
+		if err := h.resolveCredentials(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+
+	if h.client == nil {
+		// authenticate with a private key rather than the secret, if one is provided
+		if h.privateKeyFile != "" {
+			signer, err := tokenutil.LoadClientAssertionSigner(h.privateKeyFile, h.privateKeyID)
+			if err != nil {
+				return nil, err
+			}
+			h.clientOpts = append(h.clientOpts, httpc.WithClientAssertion(signer))
+		}
+
+		clientOpts := append([]httpc.ClientOpt{httpc.WithScope(h.scope), httpc.WithAudience(h.audience)}, h.clientOpts...)
+		h.client = httpc.New(h.iamServiceURL, h.vendedServiceClient, h.passedInToken, clientOpts...)
+	}
+
+	if h.verifier == nil && d.Get("iam_token_verify").(bool) {
+		v, err := verify.New(h.iamServiceURL,
+			verify.WithJWKSFile(d.Get("iam_jwks_file").(string)),
+			verify.WithAudience(d.Get("iam_verify_audience").(string)),
+		)
+		if err != nil {
+			return nil, err
+		}
+		h.verifier = v
+	}
+
+	// Tokens are cached encrypted with the client secret, there is no point caching a passed-in token
+	if h.tokenCache == nil && d.Get("iam_token_cache").(bool) && h.passedInToken == "" {
+		if h.clientSecret == "" {
+			log.Printf("[WARN] iam_token_cache is set but there is no user_secret to encrypt the cache with, tokens won't be cached")
+		} else {
+			c, err := cache.New(d.Get("iam_token_cache_dir").(string), h.clientSecret)
+			if err != nil {
+				return nil, err
+			}
+			h.tokenCache = c
+		}
+	}
 
-	// set-up retrieve thread on channel
-	h.startRetrieveThread()
+	if h.refreshFraction < 0 || h.refreshFraction >= 1 {
+		return nil, fmt.Errorf("refresh fraction %v must be in the range [0, 1)", h.refreshFraction)
+	}
 
 	return h, nil
 }
 
+// resolveCredentials fills in the credentials that weren't set by opts from the CredentialProvider.  Not
+// finding any credentials isn't an error, e.g. a token may have been passed-in.
+func (h *Handler) resolveCredentials(ctx context.Context, d *schema.ResourceData) error {
+	if h.tenantID != "" && h.clientID != "" && h.clientSecret != "" {
+		return nil
+	}
+
+	if h.credentials == nil {
+		h.credentials = credentials.DefaultChain(d)
+	}
+
+	var creds *credentials.Credentials
+	var err error
+	if h.resolved != nil {
+		creds, err = h.resolved.retrieve(ctx, h.credentials)
+	} else {
+		creds, err = h.credentials.Retrieve(ctx)
+	}
+	if errors.Is(err, credentials.ErrNoCredentials) {
+		log.Printf("[DEBUG] %s", err)
+
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if h.tenantID == "" {
+		h.tenantID = creds.TenantID
+	}
+	if h.clientID == "" {
+		h.clientID = creds.ClientID
+	}
+	if h.clientSecret == "" {
+		h.clientSecret = creds.ClientSecret
+	}
+
+	return nil
+}
+
+// resolvedCredentials the result of the CredentialProvider, retrieved once for every Handler created by
+// NewServiceHandlers so that the credential chain, which may run an exec plugin, isn't run for each of them
+type resolvedCredentials struct {
+	done  bool
+	creds *credentials.Credentials
+	err   error
+}
+
+func (r *resolvedCredentials) retrieve(ctx context.Context, p credentials.CredentialProvider) (
+	*credentials.Credentials, error) {
+	if !r.done {
+		r.creds, r.err = p.Retrieve(ctx)
+		r.done = true
+	}
+
+	return r.creds, r.err
+}
+
+// NewServiceHandlers creates a Handler for each service in regs that needs its own tokens, keyed by service
+// name.  A service needs its own tokens if its service block declares any of the provider.ServiceCredentialsSchema
+// entries, or if its registration implements registration.ServiceTokenConfig and asks for different scopes or a
+// different audience.  Anything not declared falls back to the top-level provider config.  The token retrieve
+// function for each Handler should be stored at the common.ServiceTokenRetrieveFunctionKey for the service.
+// opts are applied to each Handler.  The credentials are resolved at most once, with ctx, and shared by the
+// Handlers.
+func NewServiceHandlers(ctx context.Context, d *schema.ResourceData, regs []registration.ServiceRegistration,
+	opts ...CreateOpt) (map[string]*Handler, error) {
+	resolved := &resolvedCredentials{}
+	handlers := make(map[string]*Handler)
+	for _, reg := range regs {
+		serviceOpts := serviceCredentialOpts(d, reg.Name())
+
+		if tc, ok := reg.(registration.ServiceTokenConfig); ok {
+			if scopes := strings.Join(tc.TokenScopes(), " "); scopes != "" {
+				serviceOpts = append(serviceOpts, WithScope(scopes))
+			}
+			if audience := tc.TokenAudience(); audience != "" {
+				serviceOpts = append(serviceOpts, WithAudience(audience))
+			}
+		}
+
+		if len(serviceOpts) == 0 {
+			continue
+		}
+
+		serviceOpts = append(serviceOpts, func(h *Handler) {
+			h.resolved = resolved
+		})
+		h, err := NewHandlerContext(ctx, d, append(append([]CreateOpt{}, opts...), serviceOpts...)...)
+		if err != nil {
+			for _, created := range handlers {
+				_ = created.Close()
+			}
+
+			return nil, fmt.Errorf("service %s: %w", reg.Name(), err)
+		}
+		handlers[reg.Name()] = h
+	}
+
+	return handlers, nil
+}
+
+// serviceCredentialOpts returns CreateOpts for the credentials declared in the service block of the service
+// serviceName, credentials that aren't declared are left as the top-level provider ones
+func serviceCredentialOpts(d *schema.ResourceData, serviceName string) []CreateOpt {
+	block, ok := d.GetOk(serviceName)
+	if !ok {
+		return nil
+	}
+
+	set, ok := block.(*schema.Set)
+	if !ok || set.Len() == 0 {
+		return nil
+	}
+
+	settings, ok := set.List()[0].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	get := func(key string) string {
+		v, _ := settings[key].(string)
+
+		return v
+	}
+
+	var opts []CreateOpt
+	if url := get("iam_service_url"); url != "" {
+		opts = append(opts, WithIAMServiceURL(url))
+	}
+
+	tenantID, clientID, clientSecret := get("tenant_id"), get("user_id"), get("user_secret")
+	if tenantID != "" || clientID != "" || clientSecret != "" {
+		// The top-level passed-in token isn't used for a service with its own credentials, nor is the top-level
+		// private key for a service with its own client
+		opts = append(opts, func(h *Handler) {
+			h.passedInToken = ""
+			if clientID != "" || clientSecret != "" {
+				h.privateKeyFile, h.privateKeyID = "", ""
+			}
+			if tenantID != "" {
+				h.tenantID = tenantID
+			}
+			if clientID != "" {
+				h.clientID = clientID
+			}
+			if clientSecret != "" {
+				h.clientSecret = clientSecret
+			}
+		})
+	}
+
+	return opts
+}
+
+// Token returns the cached token, generating a new one if there isn't one or if its
+// time-to-expiry is <= common.TimeToTokenExpiry.  A token with no known expiry, i.e. an opaque passed-in
+// token, is treated as non-expiring.  Concurrent callers that need a new token share a single request to
+// IAM and each receive a copy of the same token, or the same error.  If ctx is cancelled the caller
+// stops waiting, the request to IAM is only cancelled once every caller waiting on it has given up.
+func (h *Handler) Token(ctx context.Context) (*common.Token, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+
+		return nil, common.ErrHandlerClosed
+	}
+
+	if h.token != nil && valid(h.token) {
+		h.used = true
+		token := h.currentToken()
+		h.mu.Unlock()
+
+		return token, nil
+	}
+
+	f := h.flight
+	if f == nil {
+		f = h.startFlight(context.WithCancel(context.Background()))
+	}
+	f.Join()
+	h.mu.Unlock()
+
+	val, err := f.Wait(ctx, h.detach(f))
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	h.used = true
+	h.mu.Unlock()
+
+	// Each caller gets its own copy of the token, as it does of the cached token
+	token := *val.(*common.Token)
+
+	return &token, nil
+}
+
+// detach returns a function that detaches f if it is still the in-progress refresh, so that the next caller
+// starts a new one
+func (h *Handler) detach(f *flight.Flight) func() {
+	return func() {
+		if h.flight == f {
+			h.flight = nil
+		}
+	}
+}
+
+// valid returns true if token's time-to-expiry is > common.TimeToTokenExpiry, or if its expiry isn't known
+func valid(token *common.Token) bool {
+	return token.Expiry.IsZero() || time.Until(token.Expiry) > common.TimeToTokenExpiry*time.Second
+}
+
+// currentToken returns a copy of the cached token.  It must be called with h.mu held.
+func (h *Handler) currentToken() *common.Token {
+	token := *h.token
+
+	return &token
+}
+
+// Close stops any background refresh, cancels in-flight requests to IAM and stops the thread serving
+// TokenChannels.  Callers waiting on a token, and any subsequent callers, get common.ErrHandlerClosed.
+// It should be called when the provider is torn down, it is safe to call more than once.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+
+	if h.refreshTimer != nil {
+		h.refreshTimer.Stop()
+		h.refreshTimer = nil
+	}
+
+	if h.flight != nil {
+		h.flight.Cancel()
+		h.flight = nil
+	}
+
+	if h.stopThread != nil {
+		h.stopThread()
+	}
+
+	return nil
+}
+
 // TokenChannels return channels for token retrieve function
+// The channels, and the thread that serves them, are only created on the first call.  Handler
+// implements common.TokenSource so retrieve.NewTokenRetrieveFunc doesn't use the channels.
 func (h *Handler) TokenChannels() (chan common.Result, chan int) { // nolint golint
+	h.channelsOnce.Do(func() {
+		h.resultCh = make(chan common.Result)
+		h.exitCh = make(chan int)
+		h.startRetrieveThread()
+	})
+
 	return h.resultCh, h.exitCh
 }
 
 // startRetrieveThread start the token retrieve thread
-// function in an infinite loop, it puts the return value of retrieveToken into h.resultCh by default
-// if a signal on exitCh is received the thread exits
+// It puts the return value of Token into h.resultCh, recomputing it if it isn't read within
+// pendingResultTTL so that a stale token is never presented.  If a signal on exitCh is received, or
+// the Handler is closed, the thread exits.  This cancels the context used by Token so that
+// any in-flight GenerateToken call, retry or sleep is abandoned immediately.
 func (h *Handler) startRetrieveThread() {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	h.mu.Lock()
+	h.stopThread = cancel
+	if h.closed {
+		cancel()
+	}
+	h.mu.Unlock()
+
+	// Listen for the exit signal while the retrieve thread is busy generating a token
 	go func() {
-		for {
+		select {
+		case <-h.exitCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	go func() {
+		for ctx.Err() == nil {
+			res := common.Result{}
+			token, err := h.Token(ctx)
+			if err != nil {
+				res.Err = err
+			} else {
+				res.Token = token.AccessToken
+			}
+
+			timer := time.NewTimer(pendingResultTTL)
 			select {
-			case <-h.exitCh:
-				// TODO we need to set-up a context here and cancel it so that the TokenGenerate call is killed
+			case <-ctx.Done():
+				timer.Stop()
+
 				return
-			default:
-				h.resultCh <- h.retrieveToken()
+			case h.resultCh <- res:
+				timer.Stop()
+			case <-timer.C:
 			}
 		}
 	}()
 }
 
-// retrieveToken function to get a token
-// The token is stashed in the handler.  If its time-to-expiry is <= common.TimeToTokenExpiry then it is
-// regenerated.
-// If we have to regenerate a token we will retry in the case where the error is retryable up to retryLimit times
-// Currently the only error that is retryable is a net Timeout error
-func (h *Handler) retrieveToken() common.Result {
-	// We use a loop since we may need to retry depending on the error that we get from IAM
-	// Reset numRetries
-	h.numRetries = 0
-	for {
-		// Get current time in Unix "epoch" seconds
-		now := time.Now().Unix()
-
-		// Generate token if there isn't any
-		if h.token == "" {
-			token, retry, err := h.generateToken()
-			if retry {
-				continue
-			}
+// startFlight starts a token refresh using ctx, cancel must release the resources associated with ctx.
+// It must be called with h.mu held.
+func (h *Handler) startFlight(ctx context.Context, cancel context.CancelFunc) *flight.Flight {
+	h.flight = flight.Start(ctx, cancel, &h.mu,
+		func(ctx context.Context) (interface{}, error) {
+			return h.newToken(ctx)
+		},
+		func(f *flight.Flight, val interface{}, err error) (interface{}, error) {
+			h.detach(f)()
+
+			switch {
+			case h.closed:
+				return nil, common.ErrHandlerClosed
+			case err != nil:
+				return nil, err
+			default:
+				h.storeToken(val.(*common.Token))
 
-			if err != nil {
-				return common.Result{
-					Token: "",
-					Err:   err,
-				}
+				return h.currentToken(), nil
 			}
+		})
 
-			h.token = token
-		}
+	return h.flight
+}
 
-		// Decode token
-		tokenDetails, err := tokenutil.DecodeAccessToken(h.token)
-		if err != nil {
-			return common.Result{
-				Token: "",
-				Err:   err,
-			}
-		}
+// newToken returns a new token, from the TokenCache if the Handler has one and it has a token that
+// another process got, otherwise from IAM
+func (h *Handler) newToken(ctx context.Context) (*common.Token, error) {
+	if h.tokenCache == nil {
+		return h.fetchToken(ctx)
+	}
 
-		// If token is about to expire in TimeToTokenExpiry seconds or less generate a new one
-		if tokenDetails.Expiry-now <= common.TimeToTokenExpiry {
-			token, retry, err := h.generateToken()
-			if retry {
-				continue
-			}
+	h.mu.Lock()
+	var current *common.Token
+	if h.token != nil {
+		current = h.currentToken()
+	}
+	h.mu.Unlock()
+
+	key := cache.Key{
+		Issuer:   h.iamServiceURL,
+		ClientID: h.clientID,
+		TenantID: h.tenantID,
+		Scope:    tokenutil.NormaliseScope(h.scope),
+		Audience: h.audience,
+	}
 
-			if err != nil {
-				return common.Result{
-					Token: "",
-					Err:   err,
-				}
-			}
+	return h.tokenCache.Fetch(ctx, key, current, h.fetchToken)
+}
 
-			h.token = token
-		}
+// fetchToken generates a new token.  The expiry returned by IAM is used if there is one, otherwise the
+// token is decoded to get its expiry.  A passed-in token that isn't a JWT is returned without an expiry.
+// The token is verified first if the Handler has a TokenVerifier.
+func (h *Handler) fetchToken(ctx context.Context) (*common.Token, error) {
+	token, err := h.generateToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.TokenType == "" {
+		token.TokenType = common.TokenTypeBearer
+	}
 
-		return common.Result{
-			Token: h.token,
-			Err:   nil,
+	if h.verifier == nil && !token.Expiry.IsZero() {
+		return token, nil
+	}
+
+	// Verify or decode token
+	var tokenDetails tokenutil.Token
+	if h.verifier != nil {
+		tokenDetails, err = h.verifier.Verify(ctx, token.AccessToken)
+	} else {
+		tokenDetails, err = tokenutil.DecodeAccessToken(token.AccessToken)
+		if err != nil && h.passedInToken != "" && token.AccessToken == h.passedInToken {
+			log.Printf("[DEBUG] the passed-in iam_token isn't a JWT, its expiry isn't known: %s", err)
+
+			return token, nil
 		}
 	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.Expiry.IsZero() {
+		token.Expiry = time.Unix(tokenDetails.Expiry, 0)
+	}
+
+	return token, nil
 }
 
-// generateToken simple function to call the API client's GenerateToken
-func (h *Handler) generateToken() (string, bool, error) {
-	var token string
-	var err error
+// storeToken stashes a token in the handler, a background refresh is then scheduled.
+// It must be called with h.mu held.
+func (h *Handler) storeToken(token *common.Token) {
+	previous := h.token
+	h.token = token
+	h.used = false
+
+	// There is no point refreshing in the background if IAM handed back the same token,
+	// e.g. in the case of a passed-in token
+	if previous == nil || token.AccessToken != previous.AccessToken {
+		h.scheduleRefresh(time.Now())
+	}
+}
 
-	// TODO pass a context down to here
-	token, err = h.client.GenerateToken(context.Background(), h.tenantID, h.clientID, h.clientSecret)
+// scheduleRefresh arms a timer to refresh the token after refreshFraction of its lifetime.  No
+// timer is armed if the refresh would happen after the token is due to be refreshed on demand anyway.
+// It must be called with h.mu held.
+func (h *Handler) scheduleRefresh(now time.Time) {
+	if h.refreshTimer != nil {
+		h.refreshTimer.Stop()
+		h.refreshTimer = nil
+	}
 
-	// If this is a retryable error check to see if we've reached our retryLimit or not, if we can retry again
-	// return true
-	if err != nil && isErrRetryable(err) {
-		h.numRetries++
+	if h.refreshFraction == 0 {
+		return
+	}
 
-		return token, h.numRetries <= retryLimit, err
+	lifetime := h.token.Expiry.Sub(now)
+	refreshIn := time.Duration(float64(lifetime) * h.refreshFraction)
+	if lifetime-refreshIn <= common.TimeToTokenExpiry*time.Second {
+		return
 	}
 
-	return token, false, err
+	h.refreshTimer = time.AfterFunc(refreshIn, h.backgroundRefresh)
 }
 
-// isErrRetryable checks if an error is retryable, currently limited to net Timeout errors
-func isErrRetryable(err error) bool {
-	var t net.Error
-	if errors.As(err, &t) && t.Timeout() {
-		return true
+// backgroundRefresh is run by the refresh timer.  The token is only refreshed if it has been used
+// since it was generated, so that no further refreshes are scheduled once the provider has stopped
+// asking for tokens.  Callers continue to get the current token while the refresh is in progress.
+// On error the current token is left in place, it will be refreshed on demand.
+func (h *Handler) backgroundRefresh() {
+	h.mu.Lock()
+	h.refreshTimer = nil
+	if !h.used || h.flight != nil || h.closed {
+		h.mu.Unlock()
+
+		return
+	}
+
+	f := h.startFlight(context.WithTimeout(context.Background(), backgroundRefreshTimeout))
+	// The background refresh counts as a waiter so that it isn't cancelled by callers that join it
+	f.Join()
+	h.mu.Unlock()
+
+	if _, err := f.Wait(context.Background(), h.detach(f)); err != nil {
+		log.Printf("[WARN] background token refresh failed: %s", err)
 	}
+}
 
-	return false
+// generateToken simple function to call the API client's GenerateToken
+// Retryable failures, as classified by the RetryPolicy's tokenutil.RetryClassifier, are retried by the
+// API client so that retries are made in one place
+func (h *Handler) generateToken(ctx context.Context) (*common.Token, error) {
+	return h.client.GenerateToken(ctx, h.tenantID, h.clientID, h.clientSecret)
 }
@@ -2,15 +2,32 @@ package serviceclient_test
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
 
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/mocks"
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/provider"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/registration"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/common"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/credentials"
+	tokenerrors "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/errors"
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/retrieve"
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/serviceclient"
 
@@ -100,7 +117,7 @@ func TestHandler(t *testing.T) {
 			assert.NoError(t, err)
 
 			testToken := generateTestToken(600)
-			mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(testToken, tc.err).MaxTimes(8)
+			mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&common.Token{AccessToken: testToken}, tc.err).MaxTimes(8)
 
 			handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock))
 			assert.NoError(t, err)
@@ -143,3 +160,952 @@ func (e testNetError) Temporary() bool {
 func (e testNetError) Error() string {
 	return ""
 }
+
+func TestHandlerCancelInFlight(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+	mock := mocks.NewMockIdentityAPI(ctrl)
+
+	started := make(chan struct{})
+	aborted := make(chan error, 1)
+	mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _, _, _ string) (*common.Token, error) {
+			close(started)
+			<-ctx.Done()
+			aborted <- ctx.Err()
+
+			return nil, ctx.Err()
+		}).Times(1)
+
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	_, _ = retrieve.NewTokenRetrieveFunc(handler)(ctx)
+
+	select {
+	case err = <-aborted:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight GenerateToken was not cancelled")
+	}
+}
+
+// generateLiveTestToken generates a token that expires timeToExpiry from now
+func generateLiveTestToken(timeToExpiry time.Duration) string {
+	return generateTestToken(time.Now().Add(timeToExpiry).Unix())
+}
+
+func TestHandlerLazyCachedToken(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+	mock := mocks.NewMockIdentityAPI(ctrl)
+
+	// No token is generated until one is asked for
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock), serviceclient.WithRefreshFraction(0))
+	assert.NoError(t, err)
+
+	testToken := generateLiveTestToken(time.Hour)
+	mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&common.Token{AccessToken: testToken}, nil).Times(1)
+
+	getToken := retrieve.NewTokenRetrieveFunc(handler)
+	for i := 0; i < 5; i++ {
+		token, err := getToken(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, testToken, token)
+	}
+}
+
+func TestHandlerBackgroundRefresh(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+	mock := mocks.NewMockIdentityAPI(ctrl)
+
+	// A fraction of 0.001 of a ~33 minute lifetime schedules a refresh after ~2 seconds
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock), serviceclient.WithRefreshFraction(0.001))
+	assert.NoError(t, err)
+	// Close stops the background refresh of the second token
+	defer handler.Close()
+
+	firstToken := generateLiveTestToken(2000 * time.Second)
+	secondToken := generateLiveTestToken(time.Hour)
+	refreshed := make(chan struct{})
+	gomock.InOrder(
+		mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&common.Token{AccessToken: firstToken}, nil),
+		mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+			func(context.Context, string, string, string) (*common.Token, error) {
+				close(refreshed)
+
+				return &common.Token{AccessToken: secondToken}, nil
+			}),
+	)
+
+	getToken := retrieve.NewTokenRetrieveFunc(handler)
+	token, err := getToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, firstToken, token)
+
+	select {
+	case <-refreshed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("token was not refreshed in the background")
+	}
+
+	token, err = getToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, secondToken, token)
+}
+
+func TestHandlerInvalidRefreshFraction(t *testing.T) {
+	t.Parallel()
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+
+	_, err := serviceclient.NewHandler(d, serviceclient.WithRefreshFraction(1))
+	assert.EqualError(t, err, "refresh fraction 1 must be in the range [0, 1)")
+}
+
+func TestHandlerTokenChannels(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+	mock := mocks.NewMockIdentityAPI(ctrl)
+
+	testToken := generateLiveTestToken(time.Hour)
+	mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&common.Token{AccessToken: testToken}, nil).Times(1)
+
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock), serviceclient.WithRefreshFraction(0))
+	assert.NoError(t, err)
+
+	resultCh, exitCh := handler.TokenChannels()
+	res := <-resultCh
+	assert.NoError(t, res.Err)
+	assert.Equal(t, testToken, res.Token)
+	exitCh <- 1
+}
+
+func TestHandlerSingleFlight(t *testing.T) {
+	t.Parallel()
+	const numCallers = 20
+
+	testToken := generateLiveTestToken(time.Hour)
+	var numRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		// Hold the request so that every caller is waiting on it
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"` + testToken + `","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"iam_service_url": server.URL,
+	})
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithRefreshFraction(0))
+	assert.NoError(t, err)
+	getToken := retrieve.NewTokenRetrieveFunc(handler)
+
+	var wg sync.WaitGroup
+	tokens := make([]string, numCallers)
+	errs := make([]error, numCallers)
+	for i := 0; i < numCallers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = getToken(context.Background())
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&numRequests))
+	for i := 0; i < numCallers; i++ {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, testToken, tokens[i])
+	}
+}
+
+func TestHandlerSingleFlightTokenCopies(t *testing.T) {
+	t.Parallel()
+	const numCallers = 2
+
+	testToken := generateLiveTestToken(time.Hour)
+	var numRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&numRequests, 1)
+		// Hold the request so that every caller is waiting on it
+		time.Sleep(200 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"` + testToken + `","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"iam_service_url": server.URL,
+	})
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithRefreshFraction(0))
+	assert.NoError(t, err)
+	defer handler.Close()
+
+	var wg sync.WaitGroup
+	tokens := make([]*common.Token, numCallers)
+	for i := 0; i < numCallers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			tokens[i], err = handler.Token(context.Background())
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&numRequests))
+
+	// Callers that share a request each get their own copy of the token
+	if assert.NotNil(t, tokens[0]) && assert.NotNil(t, tokens[1]) {
+		assert.NotSame(t, tokens[0], tokens[1])
+		tokens[0].AccessToken = "modified"
+		assert.Equal(t, testToken, tokens[1].AccessToken)
+	}
+
+	token, err := handler.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, testToken, token.AccessToken)
+}
+
+func TestHandlerSingleFlightSharedError(t *testing.T) {
+	t.Parallel()
+	const numCallers = 10
+	ctrl := gomock.NewController(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+	mock := mocks.NewMockIdentityAPI(ctrl)
+
+	release := make(chan struct{})
+	mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(context.Context, string, string, string) (*common.Token, error) {
+			<-release
+
+			return nil, errors.New("iam unavailable")
+		}).Times(1)
+
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock))
+	assert.NoError(t, err)
+	getToken := retrieve.NewTokenRetrieveFunc(handler)
+
+	var wg sync.WaitGroup
+	errs := make([]error, numCallers)
+	for i := 0; i < numCallers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = getToken(context.Background())
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	for i := 0; i < numCallers; i++ {
+		assert.EqualError(t, errs[i], "iam unavailable")
+	}
+}
+
+func TestHandlerSingleFlightCallerCancelled(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+	mock := mocks.NewMockIdentityAPI(ctrl)
+
+	testToken := generateLiveTestToken(time.Hour)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _, _, _ string) (*common.Token, error) {
+			close(started)
+			select {
+			case <-release:
+				return &common.Token{AccessToken: testToken}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}).Times(1)
+
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock), serviceclient.WithRefreshFraction(0))
+	assert.NoError(t, err)
+	getToken := retrieve.NewTokenRetrieveFunc(handler)
+
+	// A second caller keeps waiting on the shared request after the first caller gives up
+	type result struct {
+		token string
+		err   error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		token, err := getToken(context.Background())
+		resCh <- result{token, err}
+	}()
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = getToken(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = getToken(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	close(release)
+	res := <-resCh
+	assert.NoError(t, res.err)
+	assert.Equal(t, testToken, res.token)
+}
+
+func TestHandlerClose(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+	mock := mocks.NewMockIdentityAPI(ctrl)
+
+	started := make(chan struct{})
+	mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _, _, _ string) (*common.Token, error) {
+			close(started)
+			<-ctx.Done()
+
+			return nil, ctx.Err()
+		}).Times(1)
+
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock))
+	assert.NoError(t, err)
+	getToken := retrieve.NewTokenRetrieveFunc(handler)
+
+	// A caller waiting on an in-flight request is released by Close
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := getToken(context.Background())
+		errCh <- err
+	}()
+	<-started
+
+	assert.NoError(t, handler.Close())
+	select {
+	case err = <-errCh:
+		assert.Equal(t, common.ErrHandlerClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting caller was not released by Close")
+	}
+
+	// Subsequent callers get an error rather than blocking
+	_, err = getToken(context.Background())
+	assert.Equal(t, common.ErrHandlerClosed, err)
+
+	// Close is idempotent
+	assert.NoError(t, handler.Close())
+}
+
+func TestHandlerCloseStopsTokenChannels(t *testing.T) {
+	t.Parallel()
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+	handler, err := serviceclient.NewHandler(d)
+	assert.NoError(t, err)
+
+	assert.NoError(t, handler.Close())
+
+	resultCh, _ := handler.TokenChannels()
+	select {
+	case res := <-resultCh:
+		t.Fatalf("unexpected result from closed handler: %v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHandlerTokenSource(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+	mock := mocks.NewMockIdentityAPI(ctrl)
+
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	testToken := generateTestToken(expiry.Unix())
+	mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(&common.Token{AccessToken: testToken}, nil).Times(1)
+
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock), serviceclient.WithRefreshFraction(0))
+	assert.NoError(t, err)
+
+	token, err := handler.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, testToken, token.AccessToken)
+	assert.Equal(t, common.TokenTypeBearer, token.TokenType)
+	assert.True(t, expiry.Equal(token.Expiry))
+
+	// The handler can be used as an oauth2.TokenSource
+	oauth2Token, err := common.OAuth2TokenSource(context.Background(), handler).Token()
+	assert.NoError(t, err)
+	assert.Equal(t, testToken, oauth2Token.AccessToken)
+}
+
+func TestHandlerVerifyPassedInToken(t *testing.T) {
+	t.Parallel()
+	const issuerURL = "https://iam.example.com"
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	key := jose.JSONWebKey{Key: rsaKey, KeyID: "key-1", Algorithm: string(jose.RS256), Use: "sig"}
+
+	b, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+	assert.NoError(t, err)
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	assert.NoError(t, ioutil.WriteFile(jwksFile, b, 0600))
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader("kid", key.KeyID))
+	assert.NoError(t, err)
+	expiry := time.Now().Add(time.Hour)
+	signedToken, err := jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer: issuerURL,
+		Expiry: jwt.NewNumericDate(expiry),
+	}).CompactSerialize()
+	assert.NoError(t, err)
+
+	testcases := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{
+			name:  "token signed by issuer key",
+			token: signedToken,
+		},
+		{
+			name:    "token signed by another key",
+			token:   generateTestToken(time.Now().Unix() + 3600),
+			wantErr: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+				"iam_service_url":  issuerURL,
+				"iam_token":        tc.token,
+				"iam_token_verify": true,
+				"iam_jwks_file":    jwksFile,
+			})
+			handler, err := serviceclient.NewHandler(d)
+			assert.NoError(t, err)
+			defer handler.Close()
+
+			token, err := handler.Token(context.Background())
+			if tc.wantErr {
+				var verr *tokenerrors.ErrTokenVerification
+				assert.True(t, errors.As(err, &verr))
+
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.token, token.AccessToken)
+			assert.Equal(t, expiry.Unix(), token.Expiry.Unix())
+		})
+	}
+}
+
+func TestHandlerOpaquePassedInToken(t *testing.T) {
+	t.Parallel()
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"iam_service_url": "https://iam.example.com",
+		"iam_token":       "opaque-token",
+	})
+	handler, err := serviceclient.NewHandler(d)
+	assert.NoError(t, err)
+	defer handler.Close()
+
+	// The token isn't a JWT so its expiry isn't known, it is used as it is rather than being decoded
+	for i := 0; i < 2; i++ {
+		token, err := handler.Token(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, &common.Token{AccessToken: "opaque-token", TokenType: common.TokenTypeBearer}, token)
+	}
+}
+
+func TestHandlerTokenExpiryFromIAM(t *testing.T) {
+	t.Parallel()
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	testcases := []struct {
+		name  string
+		token *common.Token
+		want  *common.Token
+	}{
+		{
+			name:  "opaque token",
+			token: &common.Token{AccessToken: "opaque-token", Expiry: expiry, Scope: "hpe-tenant"},
+			want: &common.Token{AccessToken: "opaque-token", TokenType: common.TokenTypeBearer, Expiry: expiry,
+				Scope: "hpe-tenant"},
+		},
+		{
+			name:  "expiry returned by IAM is preferred to the JWT exp claim",
+			token: &common.Token{AccessToken: generateLiveTestToken(2 * time.Hour), TokenType: "Bearer", Expiry: expiry},
+			want:  &common.Token{TokenType: "Bearer", Expiry: expiry},
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctrl := gomock.NewController(t)
+			d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+			mock := mocks.NewMockIdentityAPI(ctrl)
+			mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(tc.token, nil).Times(1)
+
+			handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock), serviceclient.WithRefreshFraction(0))
+			assert.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				token, err := handler.Token(context.Background())
+				assert.NoError(t, err)
+				assert.Equal(t, tc.token.AccessToken, token.AccessToken)
+				assert.Equal(t, tc.want.TokenType, token.TokenType)
+				assert.True(t, tc.want.Expiry.Equal(token.Expiry))
+				assert.Equal(t, tc.want.Scope, token.Scope)
+			}
+		})
+	}
+}
+
+func TestHandlerOpaqueTokenWithoutExpiry(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+	mock := mocks.NewMockIdentityAPI(ctrl)
+	mock.EXPECT().GenerateToken(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(
+		&common.Token{AccessToken: "opaque-token"}, nil).Times(1)
+
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock))
+	assert.NoError(t, err)
+
+	// The expiry of the token can't be found
+	_, err = handler.Token(context.Background())
+	var malformed *tokenerrors.ErrMalformedJWT
+	assert.True(t, errors.As(err, &malformed))
+}
+
+func TestHandlerPrivateKeyAuthentication(t *testing.T) {
+	t.Parallel()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Empty(t, r.PostForm.Get("client_secret"))
+		assert.Equal(t, tokenutil.ClientAssertionType, r.PostForm.Get("client_assertion_type"))
+
+		tok, err := jwt.ParseSigned(r.PostForm.Get("client_assertion"))
+		assert.NoError(t, err)
+		assert.Equal(t, "key-1", tok.Headers[0].KeyID)
+		var claims jwt.Claims
+		if err = tok.Claims(&key.PublicKey, &claims); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"opaque-token","token_type":"Bearer","expires_in":3600}`))
+	}))
+	defer server.Close()
+
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"iam_service_url":       server.URL,
+		"user_id":               "client",
+		"user_secret":           "secret",
+		"user_private_key_file": keyFile,
+		"user_private_key_id":   "key-1",
+	})
+	handler, err := serviceclient.NewHandler(d, serviceclient.WithRefreshFraction(0))
+	assert.NoError(t, err)
+
+	token, err := handler.Token(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "opaque-token", token.AccessToken)
+}
+
+func TestHandlerPrivateKeyFileError(t *testing.T) {
+	t.Parallel()
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"user_private_key_file": filepath.Join(t.TempDir(), "missing.pem"),
+	})
+
+	_, err := serviceclient.NewHandler(d)
+	assert.Error(t, err)
+}
+
+// scopedRegistration a registration.ServiceRegistration that implements registration.ServiceTokenConfig
+type scopedRegistration struct {
+	name     string
+	scopes   []string
+	audience string
+}
+
+func (r scopedRegistration) Name() string                                      { return r.name }
+func (r scopedRegistration) SupportedDataSources() map[string]*schema.Resource { return nil }
+func (r scopedRegistration) SupportedResources() map[string]*schema.Resource   { return nil }
+func (r scopedRegistration) ProviderSchemaEntry() *schema.Resource             { return nil }
+func (r scopedRegistration) TokenScopes() []string                             { return r.scopes }
+func (r scopedRegistration) TokenAudience() string                             { return r.audience }
+
+// plainRegistration a registration.ServiceRegistration that doesn't implement registration.ServiceTokenConfig
+type plainRegistration struct {
+	scopedRegistration
+}
+
+func (r plainRegistration) TokenScopes() {}
+
+func newScopeEchoServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		// Echo the scope and audience back in the opaque token
+		token := r.PostForm.Get("scope") + "|" + r.PostForm.Get("audience")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": token,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestHandlerScopeAudience(t *testing.T) {
+	t.Parallel()
+	server := newScopeEchoServer(t)
+
+	testcases := []struct {
+		name   string
+		config map[string]interface{}
+		opts   []serviceclient.CreateOpt
+		want   string
+	}{
+		{
+			name: "defaults",
+			want: "hpe-tenant|",
+		},
+		{
+			name: "provider settings",
+			config: map[string]interface{}{
+				"iam_scopes":   "hpe-tenant,caas.read",
+				"iam_audience": "api://greenlake",
+			},
+			want: "hpe-tenant caas.read|api://greenlake",
+		},
+		{
+			name: "options override provider settings",
+			config: map[string]interface{}{
+				"iam_scopes":   "hpe-tenant",
+				"iam_audience": "api://greenlake",
+			},
+			opts: []serviceclient.CreateOpt{serviceclient.WithScope("caas.write"), serviceclient.WithAudience("api://caas")},
+			want: "caas.write|api://caas",
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			config := map[string]interface{}{"iam_service_url": server.URL}
+			for k, v := range tc.config {
+				config[k] = v
+			}
+			d := schema.TestResourceDataRaw(t, provider.Schema(), config)
+
+			handler, err := serviceclient.NewHandler(d, append(tc.opts, serviceclient.WithRefreshFraction(0))...)
+			assert.NoError(t, err)
+			defer handler.Close()
+
+			token, err := handler.Token(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, token.AccessToken)
+		})
+	}
+}
+
+func TestNewServiceHandlers(t *testing.T) {
+	t.Parallel()
+	server := newScopeEchoServer(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"iam_service_url": server.URL,
+		"iam_audience":    "api://greenlake",
+	})
+
+	handlers, err := serviceclient.NewServiceHandlers(context.Background(), d, []registration.ServiceRegistration{
+		scopedRegistration{name: "caas", scopes: []string{"hpe-tenant", "caas.read"}},
+		scopedRegistration{name: "vmaas", audience: "api://vmaas"},
+		scopedRegistration{name: "defaults"},
+		plainRegistration{scopedRegistration{name: "plain", scopes: []string{"plain.read"}}},
+	}, serviceclient.WithRefreshFraction(0))
+	assert.NoError(t, err)
+	assert.Len(t, handlers, 2)
+
+	for name, want := range map[string]string{
+		"caas":  "hpe-tenant caas.read|api://greenlake",
+		"vmaas": "hpe-tenant|api://vmaas",
+	} {
+		h, ok := handlers[name]
+		if !assert.True(t, ok, name) {
+			continue
+		}
+		token, err := h.Token(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, want, token.AccessToken)
+		assert.NoError(t, h.Close())
+	}
+}
+
+// credentialsRegistration a registration.ServiceRegistration whose service block declares credentials
+type credentialsRegistration struct {
+	plainRegistration
+}
+
+func (r credentialsRegistration) ProviderSchemaEntry() *schema.Resource {
+	return &schema.Resource{
+		Schema: provider.AddServiceCredentialsSchema(map[string]*schema.Schema{
+			"api_url": {Type: schema.TypeString, Optional: true},
+		}),
+	}
+}
+
+func newCredentialsEchoServer(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		// Echo the credentials back in the opaque token
+		token := r.PostForm.Get("client_id") + ":" + r.PostForm.Get("client_secret") + "@" + name
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": token,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestNewServiceHandlersCredentials(t *testing.T) {
+	t.Parallel()
+	topServer := newCredentialsEchoServer(t, "top")
+	serviceServer := newCredentialsEchoServer(t, "service")
+
+	regs := []registration.ServiceRegistration{
+		credentialsRegistration{plainRegistration{scopedRegistration{name: "caas"}}},
+		credentialsRegistration{plainRegistration{scopedRegistration{name: "vmaas"}}},
+		credentialsRegistration{plainRegistration{scopedRegistration{name: "metal"}}},
+		credentialsRegistration{plainRegistration{scopedRegistration{name: "unset"}}},
+	}
+	p := provider.NewProviderFunc(regs, func(p *schema.Provider) schema.ConfigureContextFunc { return nil })()
+
+	// The top-level private key belongs to the top-level client, so isn't used by services with their own client
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600))
+
+	d := schema.TestResourceDataRaw(t, p.Schema, map[string]interface{}{
+		"iam_service_url":       topServer.URL,
+		"iam_token":             "passed-in-token",
+		"user_id":               "top-client",
+		"user_secret":           "top-secret",
+		"user_private_key_file": keyFile,
+		"caas": []interface{}{map[string]interface{}{
+			"user_id":     "caas-client",
+			"user_secret": "caas-secret",
+		}},
+		"vmaas": []interface{}{map[string]interface{}{
+			"iam_service_url": serviceServer.URL,
+			"user_id":         "vmaas-client",
+		}},
+		"metal": []interface{}{map[string]interface{}{
+			"api_url": "https://metal.example.com",
+		}},
+	})
+
+	handlers, err := serviceclient.NewServiceHandlers(context.Background(), d, regs, serviceclient.WithRefreshFraction(0))
+	assert.NoError(t, err)
+	assert.Len(t, handlers, 2)
+
+	for name, want := range map[string]string{
+		"caas":  "caas-client:caas-secret@top",
+		"vmaas": "vmaas-client:top-secret@service",
+	} {
+		h, ok := handlers[name]
+		if !assert.True(t, ok, name) {
+			continue
+		}
+		token, err := h.Token(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, want, token.AccessToken)
+		assert.NoError(t, h.Close())
+	}
+}
+
+// ctxKey the key of a context value used to check that a context is passed through
+type ctxKey struct{}
+
+func TestNewServiceHandlersResolveCredentialsOnce(t *testing.T) {
+	t.Parallel()
+	server := newScopeEchoServer(t)
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"iam_service_url": server.URL,
+	})
+	p := &countingProvider{creds: credentials.Credentials{
+		TenantID: "chain-tenant", ClientID: "chain-id", ClientSecret: "chain-secret",
+	}}
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "configure")
+	handlers, err := serviceclient.NewServiceHandlers(ctx, d, []registration.ServiceRegistration{
+		scopedRegistration{name: "caas", scopes: []string{"caas.read"}},
+		scopedRegistration{name: "vmaas", scopes: []string{"vmaas.read"}},
+	}, serviceclient.WithCredentialProvider(p), serviceclient.WithRefreshFraction(0))
+	assert.NoError(t, err)
+	assert.Len(t, handlers, 2)
+	for _, h := range handlers {
+		assert.NoError(t, h.Close())
+	}
+
+	// The credential chain is run once, with the context passed in, rather than for every Handler
+	assert.Equal(t, int32(1), atomic.LoadInt32(&p.calls))
+	if assert.NotNil(t, p.ctx) {
+		assert.Equal(t, "configure", p.ctx.Value(ctxKey{}))
+	}
+}
+
+func TestHandlerTokenCache(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	dir := t.TempDir()
+	token := &common.Token{AccessToken: "cached-token", Expiry: time.Now().Add(time.Hour)}
+
+	// The second Handler, e.g. in the provider process of a later terraform run, gets the token from the cache
+	for i, calls := range []int{1, 0} {
+		d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+			"iam_service_url":     "https://iam.example.com",
+			"tenant_id":           "tenant",
+			"user_id":             "client",
+			"user_secret":         "secret",
+			"iam_token_cache":     true,
+			"iam_token_cache_dir": dir,
+		})
+		mock := mocks.NewMockIdentityAPI(ctrl)
+		mock.EXPECT().GenerateToken(gomock.Any(), "tenant", "client", "secret").Return(token, nil).Times(calls)
+
+		handler, err := serviceclient.NewHandler(d, serviceclient.WithIdentityAPI(mock), serviceclient.WithRefreshFraction(0))
+		assert.NoError(t, err)
+
+		got, err := handler.Token(context.Background())
+		assert.NoError(t, err, "handler %d", i)
+		assert.Equal(t, "cached-token", got.AccessToken)
+		assert.Equal(t, common.TokenTypeBearer, got.TokenType)
+		assert.NoError(t, handler.Close())
+	}
+}
+
+// countingProvider a credentials.CredentialProvider that counts the calls made to it, and records the context
+// of the last call
+type countingProvider struct {
+	calls int32
+	creds credentials.Credentials
+	ctx   context.Context
+}
+
+func (p *countingProvider) Name() string { return "counting provider" }
+
+func (p *countingProvider) Retrieve(ctx context.Context) (*credentials.Credentials, error) {
+	atomic.AddInt32(&p.calls, 1)
+	p.ctx = ctx
+	creds := p.creds
+
+	return &creds, nil
+}
+
+func TestHandlerCredentialProvider(t *testing.T) {
+	t.Parallel()
+	token := &common.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)}
+
+	testcases := []struct {
+		name      string
+		opts      []serviceclient.CreateOpt
+		wantCalls int32
+		want      []string
+	}{
+		{
+			name:      "credentials from the provider",
+			wantCalls: 1,
+			want:      []string{"chain-tenant", "chain-id", "chain-secret"},
+		},
+		{
+			name: "credentials set by an opt take precedence",
+			opts: []serviceclient.CreateOpt{
+				serviceclient.WithCredentials("opt-tenant", "opt-id", "opt-secret"),
+			},
+			wantCalls: 0,
+			want:      []string{"opt-tenant", "opt-id", "opt-secret"},
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctrl := gomock.NewController(t)
+			d := schema.TestResourceDataRaw(t, provider.Schema(), make(map[string]interface{}))
+			mock := mocks.NewMockIdentityAPI(ctrl)
+			mock.EXPECT().GenerateToken(gomock.Any(), tc.want[0], tc.want[1], tc.want[2]).Return(token, nil).Times(1)
+			p := &countingProvider{creds: credentials.Credentials{
+				TenantID: "chain-tenant", ClientID: "chain-id", ClientSecret: "chain-secret",
+			}}
+
+			opts := append([]serviceclient.CreateOpt{serviceclient.WithIdentityAPI(mock),
+				serviceclient.WithCredentialProvider(p)}, tc.opts...)
+			handler, err := serviceclient.NewHandler(d, opts...)
+			assert.NoError(t, err)
+			defer handler.Close()
+
+			_, err = handler.Token(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantCalls, atomic.LoadInt32(&p.calls))
+		})
+	}
+}
+
+func TestHandlerCredentialProviderError(t *testing.T) {
+	t.Parallel()
+	if os.Getenv(credentials.UserIDEnv) != "" {
+		t.Skip("credentials are set in the environment, the exec plugin won't be run")
+	}
+	dir := t.TempDir()
+	d := schema.TestResourceDataRaw(t, provider.Schema(), map[string]interface{}{
+		"credentials_file": filepath.Join(dir, "missing-credentials"),
+		"credentials_exec": filepath.Join(dir, "missing-plugin"),
+	})
+
+	_, err := serviceclient.NewHandler(d)
+	assert.Error(t, err)
+}
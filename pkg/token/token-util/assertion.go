@@ -0,0 +1,136 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package tokenutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	// ClientAssertionType the client_assertion_type sent with a client assertion, see RFC 7523 section 2.2
+	ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// clientAssertionLifetime is how long a client assertion is valid for
+	clientAssertionLifetime = 5 * time.Minute
+)
+
+// ClientAssertionSigner signs the JWTs used by a service client to authenticate with a private key
+// rather than a client secret, see RFC 7523
+type ClientAssertionSigner struct {
+	key       crypto.Signer
+	algorithm jose.SignatureAlgorithm
+	keyID     string
+}
+
+// LoadClientAssertionSigner creates a ClientAssertionSigner from a PEM file containing an unencrypted
+// RSA or EC private key.  keyID, if set, is sent as the kid header of the assertions.
+func LoadClientAssertionSigner(path, keyID string) (*ClientAssertionSigner, error) {
+	b, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewClientAssertionSigner(b, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("private key file %s: %w", path, err)
+	}
+
+	return s, nil
+}
+
+// NewClientAssertionSigner creates a ClientAssertionSigner from a PEM encoded unencrypted RSA or EC
+// private key, in PKCS #1, SEC 1 or PKCS #8 form
+func NewClientAssertionSigner(pemBytes []byte, keyID string) (*ClientAssertionSigner, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ClientAssertionSigner{keyID: keyID}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		s.key, s.algorithm = k, jose.RS256
+	case *ecdsa.PrivateKey:
+		s.key = k
+		switch k.Curve {
+		case elliptic.P256():
+			s.algorithm = jose.ES256
+		case elliptic.P384():
+			s.algorithm = jose.ES384
+		case elliptic.P521():
+			s.algorithm = jose.ES512
+		default:
+			return nil, fmt.Errorf("unsupported EC curve %s", k.Curve.Params().Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+
+	return s, nil
+}
+
+// Algorithm returns the algorithm used to sign assertions
+func (s *ClientAssertionSigner) Algorithm() jose.SignatureAlgorithm {
+	return s.algorithm
+}
+
+// Assertion returns a signed client assertion for clientID, audience is the URL of the token endpoint
+func (s *ClientAssertionSigner) Assertion(clientID, audience string) (string, error) {
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if s.keyID != "" {
+		opts = opts.WithHeader("kid", s.keyID)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: s.algorithm, Key: s.key}, opts)
+	if err != nil {
+		return "", err
+	}
+
+	jti := make([]byte, 16)
+	if _, err = rand.Read(jti); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.Claims{
+		Issuer:   clientID,
+		Subject:  clientID,
+		Audience: jwt.Audience{audience},
+		ID:       hex.EncodeToString(jti),
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(clientAssertionLifetime)),
+	}
+
+	return jwt.Signed(signer).Claims(claims).CompactSerialize()
+}
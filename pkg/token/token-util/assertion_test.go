@@ -0,0 +1,173 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package tokenutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func encodeTestKey(t *testing.T, blockType string, key interface{}) []byte {
+	t.Helper()
+	var der []byte
+	var err error
+	switch blockType {
+	case "RSA PRIVATE KEY":
+		der = x509.MarshalPKCS1PrivateKey(key.(*rsa.PrivateKey))
+	case "EC PRIVATE KEY":
+		der, err = x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+	default:
+		der, err = x509.MarshalPKCS8PrivateKey(key)
+	}
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+}
+
+func TestClientAssertionSigner(t *testing.T) {
+	t.Parallel()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name      string
+		blockType string
+		key       crypto.Signer
+		algorithm jose.SignatureAlgorithm
+	}{
+		{
+			name:      "PKCS1 RSA key",
+			blockType: "RSA PRIVATE KEY",
+			key:       rsaKey,
+			algorithm: jose.RS256,
+		},
+		{
+			name:      "PKCS8 RSA key",
+			blockType: "PRIVATE KEY",
+			key:       rsaKey,
+			algorithm: jose.RS256,
+		},
+		{
+			name:      "SEC1 P-256 key",
+			blockType: "EC PRIVATE KEY",
+			key:       p256Key,
+			algorithm: jose.ES256,
+		},
+		{
+			name:      "PKCS8 P-384 key",
+			blockType: "PRIVATE KEY",
+			key:       p384Key,
+			algorithm: jose.ES384,
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			s, err := NewClientAssertionSigner(encodeTestKey(t, tc.blockType, tc.key), "key-1")
+			require.NoError(t, err)
+			assert.Equal(t, tc.algorithm, s.Algorithm())
+
+			assertion, err := s.Assertion("client", "https://iam.example.com/v1/token")
+			require.NoError(t, err)
+
+			tok, err := jwt.ParseSigned(assertion)
+			require.NoError(t, err)
+			require.Len(t, tok.Headers, 1)
+			assert.Equal(t, "key-1", tok.Headers[0].KeyID)
+			assert.Equal(t, string(tc.algorithm), tok.Headers[0].Algorithm)
+
+			var claims jwt.Claims
+			require.NoError(t, tok.Claims(tc.key.Public(), &claims))
+			assert.NoError(t, claims.Validate(jwt.Expected{
+				Issuer:   "client",
+				Subject:  "client",
+				Audience: jwt.Audience{"https://iam.example.com/v1/token"},
+				Time:     time.Now(),
+			}))
+			assert.NotEmpty(t, claims.ID)
+
+			// Every assertion has a unique id
+			other, err := s.Assertion("client", "https://iam.example.com/v1/token")
+			require.NoError(t, err)
+			otherTok, err := jwt.ParseSigned(other)
+			require.NoError(t, err)
+			var otherClaims jwt.Claims
+			require.NoError(t, otherTok.Claims(tc.key.Public(), &otherClaims))
+			assert.NotEqual(t, claims.ID, otherClaims.ID)
+		})
+	}
+}
+
+func TestClientAssertionSignerErrors(t *testing.T) {
+	t.Parallel()
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name string
+		pem  []byte
+		msg  string
+	}{
+		{
+			name: "no PEM data",
+			pem:  []byte("not a key"),
+			msg:  "no PEM data found",
+		},
+		{
+			name: "unsupported block type",
+			pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("cert")}),
+			msg:  `unsupported PEM block type "CERTIFICATE"`,
+		},
+		{
+			name: "unsupported curve",
+			pem:  encodeTestKey(t, "EC PRIVATE KEY", p224Key),
+			msg:  "unsupported EC curve P-224",
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			_, err := NewClientAssertionSigner(tc.pem, "")
+			assert.EqualError(t, err, tc.msg)
+		})
+	}
+}
+
+func TestLoadClientAssertionSigner(t *testing.T) {
+	t.Parallel()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(path, encodeTestKey(t, "EC PRIVATE KEY", key), 0600))
+
+	s, err := LoadClientAssertionSigner(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, jose.ES256, s.Algorithm())
+
+	_, err = LoadClientAssertionSigner(filepath.Join(dir, "missing.pem"), "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,77 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package tokenutil
+
+import "strings"
+
+// DefaultScope is the scope asked for in issuer token requests if none is specified
+const DefaultScope = "hpe-tenant"
+
+// RequestOptions the options used when making a token request to IAM
+type RequestOptions struct {
+	RetryPolicy RetryPolicy
+	// ClientAssertion, if set, is used to authenticate the client in place of the client secret
+	ClientAssertion *ClientAssertionSigner
+	// Scope is the space-separated list of scopes asked for
+	Scope string
+	// Audience, if set, is the audience asked for
+	Audience string
+}
+
+// RequestOpt - function option definition for token requests
+type RequestOpt func(o *RequestOptions)
+
+// WithRetryPolicy override the RetryPolicy used for a token request
+func WithRetryPolicy(p RetryPolicy) RequestOpt {
+	return func(o *RequestOptions) {
+		o.RetryPolicy = p
+	}
+}
+
+// WithClientAssertion authenticate the client with a client assertion signed by s, see RFC 7523
+func WithClientAssertion(s *ClientAssertionSigner) RequestOpt {
+	return func(o *RequestOptions) {
+		o.ClientAssertion = s
+	}
+}
+
+// WithScope override DefaultScope, scope is a space or comma separated list of scopes.  An empty scope
+// leaves the scope unchanged.
+func WithScope(scope string) RequestOpt {
+	return func(o *RequestOptions) {
+		if s := NormaliseScope(scope); s != "" {
+			o.Scope = s
+		}
+	}
+}
+
+// WithAudience sets the audience asked for
+func WithAudience(audience string) RequestOpt {
+	return func(o *RequestOptions) {
+		o.Audience = audience
+	}
+}
+
+// NormaliseScope converts a space or comma separated list of scopes into the space-separated form used
+// in token requests
+func NormaliseScope(scope string) string {
+	return strings.Join(strings.FieldsFunc(scope, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}), " ")
+}
+
+// NewRequestOptions returns the default RequestOptions with opts applied
+func NewRequestOptions(opts ...RequestOpt) RequestOptions {
+	o := RequestOptions{
+		RetryPolicy: DefaultRetryPolicy(),
+		Scope:       DefaultScope,
+	}
+
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&o)
+		}
+	}
+
+	return o
+}
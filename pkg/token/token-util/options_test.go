@@ -0,0 +1,38 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package tokenutil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormaliseScope(t *testing.T) {
+	t.Parallel()
+	testcases := []struct {
+		scope string
+		want  string
+	}{
+		{scope: "", want: ""},
+		{scope: "hpe-tenant", want: "hpe-tenant"},
+		{scope: "hpe-tenant caas.read", want: "hpe-tenant caas.read"},
+		{scope: " hpe-tenant,caas.read ,  caas.write\n", want: "hpe-tenant caas.read caas.write"},
+	}
+
+	for _, tc := range testcases {
+		assert.Equal(t, tc.want, NormaliseScope(tc.scope), tc.scope)
+	}
+}
+
+func TestNewRequestOptions(t *testing.T) {
+	t.Parallel()
+	o := NewRequestOptions()
+	assert.Equal(t, DefaultScope, o.Scope)
+	assert.Empty(t, o.Audience)
+	assert.Nil(t, o.ClientAssertion)
+
+	o = NewRequestOptions(WithScope("caas.read"), WithAudience("api://caas"), nil)
+	assert.Equal(t, "caas.read", o.Scope)
+	assert.Equal(t, "api://caas", o.Audience)
+}
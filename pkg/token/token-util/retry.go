@@ -0,0 +1,279 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package tokenutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RetryDecision the result of classifying the outcome of a call
+type RetryDecision struct {
+	Retry bool
+	// Reason describes the decision, for logging
+	Reason string
+}
+
+// RetryClassifier decides if a call should be retried given its response or, if it failed, its error
+type RetryClassifier func(resp *http.Response, err error) RetryDecision
+
+// RetryPolicy configures the retries made by DoRetries
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of calls made, including the first one
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, it is doubled for each subsequent retry
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential backoff delay
+	MaxDelay time.Duration
+	// Jitter is the fraction, in the range [0, 1], of each backoff delay that is randomised
+	Jitter float64
+	// MaxElapsedTime bounds the total time spent in DoRetries, a retry isn't made if it
+	// would start after this.  Zero means no limit.
+	MaxElapsedTime time.Duration
+	// Classifier decides which calls are retried, DefaultRetryClassifier is used if it is nil
+	Classifier RetryClassifier
+	// OnRetry, if set, is called before each retry is made.  If it is nil the retry is logged.
+	OnRetry func(attempt int, decision RetryDecision, delay time.Duration)
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used when none is specified
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    4,
+		BaseDelay:      time.Second,
+		MaxDelay:       30 * time.Second,
+		Jitter:         0.5,
+		MaxElapsedTime: 2 * time.Minute,
+	}
+}
+
+// maxDrainBytes is the maximum number of bytes read from a discarded response body so that the
+// connection can be reused
+const maxDrainBytes = 4096
+
+// DoRequestWithRetries sends req using httpClient, retrying as per policy.  Every attempt sends the
+// full request body, the body is rewound for each retry using req.GetBody which is set by
+// http.NewRequestWithContext for in-memory bodies.
+func DoRequestWithRetries(ctx context.Context, httpClient HttpClient, req *http.Request,
+	policy RetryPolicy) (*http.Response, error) {
+	attempt := 0
+
+	return DoRetries(ctx, func() (*http.Response, error) {
+		attempt++
+		if attempt == 1 {
+			return httpClient.Do(req)
+		}
+
+		r := req.Clone(ctx)
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return nil, errors.New("request body can't be rewound for retry")
+			}
+
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		return httpClient.Do(r)
+	}, policy)
+}
+
+// DoRetries executes call, retrying as per policy if policy.Classifier decides that the response, or
+// the error, is retryable.  The delay between retries is the exponential backoff delay, or the delay
+// requested by a Retry-After header if that is longer.  The last response, or error, is returned if a
+// retry isn't possible within policy.MaxElapsedTime, or before the deadline of ctx.  The wait between
+// retries is abandoned, and ctx.Err() returned, if ctx is cancelled.  The bodies of responses that are
+// discarded are drained and closed.
+func DoRetries(ctx context.Context, call func() (*http.Response, error), policy RetryPolicy) (*http.Response, error) {
+	classify := policy.Classifier
+	if classify == nil {
+		classify = DefaultRetryClassifier
+	}
+
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		resp, err := call()
+
+		decision := classify(resp, err)
+		if !decision.Retry || attempt >= policy.MaxAttempts {
+			return resp, err
+		}
+
+		delay := policy.backoff(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok && retryAfter > delay {
+				delay = retryAfter
+			}
+		}
+
+		wake := time.Now().Add(delay)
+		if policy.MaxElapsedTime > 0 && wake.Sub(start) > policy.MaxElapsedTime {
+			return resp, err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && wake.After(deadline) {
+			return resp, err
+		}
+
+		if policy.OnRetry != nil {
+			policy.OnRetry(attempt, decision, delay)
+		} else {
+			log.Printf("[DEBUG] retrying token request in %s after attempt %d: %s", delay, attempt, decision.Reason)
+		}
+
+		// This response is being discarded
+		drainAndClose(resp)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// DefaultRetryClassifier retries the following:
+//   - 429, 500, 502, 503 and 504 status codes
+//   - network timeouts, including TLS handshake timeouts
+//   - connections that are refused, reset or closed by the server
+//   - temporary DNS failures
+//
+// Cancellation of the request context is never retried.
+func DefaultRetryClassifier(resp *http.Response, err error) RetryDecision {
+	if err == nil {
+		if resp == nil {
+			return RetryDecision{Reason: "no response"}
+		}
+
+		return RetryDecision{
+			Retry:  isStatusRetryable(resp.StatusCode),
+			Reason: fmt.Sprintf("status code %d", resp.StatusCode),
+		}
+	}
+
+	return classifyError(err)
+}
+
+// IsErrRetryable checks if an error is retryable according to DefaultRetryClassifier
+func IsErrRetryable(err error) bool {
+	return err != nil && DefaultRetryClassifier(nil, err).Retry
+}
+
+func classifyError(err error) RetryDecision {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return RetryDecision{Reason: "context done: " + err.Error()}
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTemporary || dnsErr.IsTimeout {
+			return RetryDecision{Retry: true, Reason: "temporary DNS failure: " + err.Error()}
+		}
+
+		return RetryDecision{Reason: "DNS failure: " + err.Error()}
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return RetryDecision{Retry: true, Reason: "connection reset: " + err.Error()}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return RetryDecision{Retry: true, Reason: "connection refused: " + err.Error()}
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return RetryDecision{Retry: true, Reason: "connection closed: " + err.Error()}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		if strings.Contains(err.Error(), "TLS handshake timeout") {
+			return RetryDecision{Retry: true, Reason: "TLS handshake timeout: " + err.Error()}
+		}
+
+		return RetryDecision{Retry: true, Reason: "timeout: " + err.Error()}
+	}
+
+	return RetryDecision{Reason: "non-retryable error: " + err.Error()}
+}
+
+// drainAndClose reads what remains of a response body, up to maxDrainBytes, and closes it
+func drainAndClose(resp *http.Response) {
+	if resp == nil || resp.Body == nil {
+		return
+	}
+
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrainBytes))
+	_ = resp.Body.Close()
+}
+
+// backoff returns the delay before the retry that follows attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if p.Jitter > 0 {
+		delay -= time.Duration(p.Jitter * rand.Float64() * float64(delay)) // nolint gosec
+	}
+
+	return delay
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds
+// or an HTTP-date, into a delay from now
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+
+	return 0, true
+}
+
+func isStatusRetryable(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,443 @@
+//(C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package tokenutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPolicy allows a single retry with a short delay
+var testPolicy = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+
+// nolint: tparallel
+func TestDoRetries(t *testing.T) {
+	t.Parallel()
+	totalRetries := 0
+	testcases := []struct {
+		name           string
+		call           func() (*http.Response, error)
+		responseStatus int
+		err            error
+	}{
+		{
+			name: "status 500",
+			call: func() (*http.Response, error) {
+				totalRetries++
+
+				return &http.Response{StatusCode: http.StatusInternalServerError}, nil
+			},
+			responseStatus: http.StatusInternalServerError,
+		},
+		{
+			name: "status 429",
+			call: func() (*http.Response, error) {
+				totalRetries++
+
+				return &http.Response{StatusCode: http.StatusTooManyRequests}, nil
+			},
+			responseStatus: http.StatusTooManyRequests,
+		},
+		{
+			name: "status 502",
+			call: func() (*http.Response, error) {
+				totalRetries++
+
+				return &http.Response{StatusCode: http.StatusBadGateway}, nil
+			},
+			responseStatus: http.StatusBadGateway,
+		},
+		{
+			name: "status 404 no retry",
+			call: func() (*http.Response, error) {
+				totalRetries++
+
+				return &http.Response{StatusCode: http.StatusNotFound}, nil
+			},
+			responseStatus: http.StatusNotFound,
+		},
+		{
+			name: "no url",
+			call: func() (*http.Response, error) {
+				return nil, errors.New("http: nil Request.URL")
+			},
+			err: errors.New("http: nil Request.URL"),
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := DoRetries(context.Background(), tc.call, testPolicy) // nolint: bodyclose
+			if tc.err != nil {
+				assert.EqualError(t, err, tc.err.Error())
+			} else {
+				assert.Equal(t, tc.responseStatus, resp.StatusCode)
+
+				// only 429, 500, 502, 503 and 504 status codes should retry
+				if tc.responseStatus == http.StatusNotFound {
+					assert.Equal(t, 1, totalRetries)
+				} else {
+					assert.Equal(t, 2, totalRetries)
+				}
+
+				totalRetries = 0
+			}
+		})
+	}
+}
+
+func TestDoRetriesCancelledContext(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	call := func() (*http.Response, error) {
+		calls++
+		cancel()
+
+		return &http.Response{StatusCode: http.StatusInternalServerError}, nil
+	}
+
+	start := time.Now()
+	resp, err := DoRetries(ctx, call, RetryPolicy{MaxAttempts: 4, BaseDelay: 3 * time.Second}) // nolint: bodyclose
+	assert.Nil(t, resp)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, calls)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestDoRetriesRetryAfter(t *testing.T) {
+	t.Parallel()
+	calls := 0
+	call := func() (*http.Response, error) {
+		calls++
+		resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+		if calls == 1 {
+			resp.Header.Set("Retry-After", "1")
+		} else {
+			resp.StatusCode = http.StatusOK
+		}
+
+		return resp, nil
+	}
+
+	start := time.Now()
+	resp, err := DoRetries(context.Background(), call, testPolicy) // nolint: bodyclose
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, calls)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestDoRetriesDeadline(t *testing.T) {
+	t.Parallel()
+	testcases := []struct {
+		name    string
+		policy  RetryPolicy
+		timeout time.Duration
+	}{
+		{
+			name:   "max elapsed time",
+			policy: RetryPolicy{MaxAttempts: 4, BaseDelay: time.Hour, MaxElapsedTime: time.Minute},
+		},
+		{
+			name:    "context deadline",
+			policy:  RetryPolicy{MaxAttempts: 4, BaseDelay: time.Hour},
+			timeout: time.Minute,
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			if tc.timeout != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+
+			calls := 0
+			call := func() (*http.Response, error) {
+				calls++
+
+				return &http.Response{StatusCode: http.StatusInternalServerError}, nil
+			}
+
+			// The last response is returned straight away since the retry can't be made in time
+			resp, err := DoRetries(ctx, call, tc.policy) // nolint: bodyclose
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+			assert.Equal(t, 1, calls)
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	assert.Equal(t, time.Second, policy.backoff(1))
+	assert.Equal(t, 2*time.Second, policy.backoff(2))
+	assert.Equal(t, 4*time.Second, policy.backoff(3))
+	assert.Equal(t, 5*time.Second, policy.backoff(4))
+	assert.Equal(t, 5*time.Second, policy.backoff(40))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.backoff(2)
+		assert.GreaterOrEqual(t, int64(delay), int64(time.Second))
+		assert.LessOrEqual(t, int64(delay), int64(2*time.Second))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2021, time.June, 1, 12, 0, 0, 0, time.UTC)
+	testcases := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{value: "", ok: false},
+		{value: "120", delay: 2 * time.Minute, ok: true},
+		{value: " 0 ", delay: 0, ok: true},
+		{value: "-1", ok: false},
+		{value: "Tue, 01 Jun 2021 12:00:30 GMT", delay: 30 * time.Second, ok: true},
+		{value: "Tue, 01 Jun 2021 11:59:00 GMT", delay: 0, ok: true},
+		{value: "soon", ok: false},
+	}
+
+	for _, tc := range testcases {
+		delay, ok := parseRetryAfter(tc.value, now)
+		assert.Equal(t, tc.ok, ok, tc.value)
+		assert.Equal(t, tc.delay, delay, tc.value)
+	}
+}
+
+type testNetError struct {
+	msg     string
+	timeout bool
+}
+
+func (e testNetError) Error() string   { return e.msg }
+func (e testNetError) Timeout() bool   { return e.timeout }
+func (e testNetError) Temporary() bool { return e.timeout }
+
+func TestDefaultRetryClassifier(t *testing.T) {
+	t.Parallel()
+	opErr := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://iam", Err: &net.OpError{Op: "read", Net: "tcp", Err: err}}
+	}
+
+	testcases := []struct {
+		name   string
+		resp   *http.Response
+		err    error
+		retry  bool
+		reason string
+	}{
+		{name: "status 200", resp: &http.Response{StatusCode: http.StatusOK}, reason: "status code 200"},
+		{name: "status 400", resp: &http.Response{StatusCode: http.StatusBadRequest}, reason: "status code 400"},
+		{name: "status 429", resp: &http.Response{StatusCode: http.StatusTooManyRequests}, retry: true, reason: "status code 429"},
+		{name: "status 500", resp: &http.Response{StatusCode: http.StatusInternalServerError}, retry: true, reason: "status code 500"},
+		{name: "status 502", resp: &http.Response{StatusCode: http.StatusBadGateway}, retry: true, reason: "status code 502"},
+		{name: "status 503", resp: &http.Response{StatusCode: http.StatusServiceUnavailable}, retry: true, reason: "status code 503"},
+		{name: "status 504", resp: &http.Response{StatusCode: http.StatusGatewayTimeout}, retry: true, reason: "status code 504"},
+		{
+			name:   "connection reset",
+			err:    opErr(syscall.ECONNRESET),
+			retry:  true,
+			reason: "connection reset: Post \"https://iam\": read tcp: connection reset by peer",
+		},
+		{
+			name:   "connection refused",
+			err:    opErr(syscall.ECONNREFUSED),
+			retry:  true,
+			reason: "connection refused: Post \"https://iam\": read tcp: connection refused",
+		},
+		{
+			name:   "connection closed",
+			err:    &url.Error{Op: "Post", URL: "https://iam", Err: io.EOF},
+			retry:  true,
+			reason: "connection closed: Post \"https://iam\": EOF",
+		},
+		{
+			name:   "temporary DNS failure",
+			err:    &net.DNSError{Err: "server misbehaving", Name: "iam", IsTemporary: true},
+			retry:  true,
+			reason: "temporary DNS failure: lookup iam: server misbehaving",
+		},
+		{
+			name:   "DNS not found",
+			err:    &net.DNSError{Err: "no such host", Name: "iam", IsNotFound: true},
+			reason: "DNS failure: lookup iam: no such host",
+		},
+		{
+			name:   "TLS handshake timeout",
+			err:    testNetError{msg: "net/http: TLS handshake timeout", timeout: true},
+			retry:  true,
+			reason: "TLS handshake timeout: net/http: TLS handshake timeout",
+		},
+		{
+			name:   "timeout",
+			err:    testNetError{msg: "i/o timeout", timeout: true},
+			retry:  true,
+			reason: "timeout: i/o timeout",
+		},
+		{
+			name:   "context cancelled",
+			err:    &url.Error{Op: "Post", URL: "https://iam", Err: context.Canceled},
+			reason: "context done: Post \"https://iam\": context canceled",
+		},
+		{
+			name:   "other error",
+			err:    errors.New("http: nil Request.URL"),
+			reason: "non-retryable error: http: nil Request.URL",
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			decision := DefaultRetryClassifier(tc.resp, tc.err)
+			assert.Equal(t, RetryDecision{Retry: tc.retry, Reason: tc.reason}, decision)
+			if tc.err != nil {
+				assert.Equal(t, tc.retry, IsErrRetryable(tc.err))
+			}
+		})
+	}
+}
+
+func TestDoRetriesConnectionRefused(t *testing.T) {
+	t.Parallel()
+	// Get the address of a server that is no longer listening
+	server := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	serverURL := server.URL
+	server.Close()
+
+	var decisions []RetryDecision
+	policy := testPolicy
+	policy.MaxAttempts = 3
+	policy.OnRetry = func(attempt int, decision RetryDecision, delay time.Duration) {
+		decisions = append(decisions, decision)
+	}
+
+	calls := 0
+	_, err := DoRetries(context.Background(), func() (*http.Response, error) { // nolint: bodyclose
+		calls++
+
+		return http.Get(serverURL) // nolint: noctx
+	}, policy)
+	assert.True(t, errors.Is(err, syscall.ECONNREFUSED))
+	assert.Equal(t, 3, calls)
+	assert.Len(t, decisions, 2)
+	for _, decision := range decisions {
+		assert.True(t, decision.Retry)
+		assert.Contains(t, decision.Reason, "connection refused")
+	}
+}
+
+func TestDoRetriesCustomClassifier(t *testing.T) {
+	t.Parallel()
+	policy := testPolicy
+	policy.MaxAttempts = 3
+	policy.Classifier = func(resp *http.Response, err error) RetryDecision {
+		return RetryDecision{Retry: resp.StatusCode == http.StatusNotFound, Reason: "custom"}
+	}
+
+	calls := 0
+	resp, err := DoRetries(context.Background(), func() (*http.Response, error) { // nolint: bodyclose
+		calls++
+
+		return &http.Response{StatusCode: http.StatusNotFound}, nil
+	}, policy)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, 3, calls)
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+
+	return nil
+}
+
+func TestDoRetriesClosesDiscardedResponses(t *testing.T) {
+	t.Parallel()
+	var bodies []*closeRecorder
+	call := func() (*http.Response, error) {
+		body := &closeRecorder{Reader: strings.NewReader("error")}
+		bodies = append(bodies, body)
+
+		return &http.Response{StatusCode: http.StatusInternalServerError, Body: body}, nil
+	}
+
+	policy := testPolicy
+	policy.MaxAttempts = 3
+	resp, err := DoRetries(context.Background(), call, policy)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Len(t, bodies, 3)
+	assert.True(t, bodies[0].closed)
+	assert.True(t, bodies[1].closed)
+	// The body of the response returned is left for the caller
+	assert.False(t, bodies[2].closed)
+}
+
+type recordingHTTPClient struct {
+	bodies []string
+}
+
+func (r *recordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.bodies = append(r.bodies, string(b))
+
+	return &http.Response{StatusCode: http.StatusInternalServerError, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestDoRequestWithRetries(t *testing.T) {
+	t.Parallel()
+	policy := testPolicy
+	policy.MaxAttempts = 3
+
+	httpClient := &recordingHTTPClient{}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, "https://iam", strings.NewReader("payload"))
+	require.NoError(t, err)
+	resp, err := DoRequestWithRetries(context.Background(), httpClient, req, policy)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, []string{"payload", "payload", "payload"}, httpClient.bodies)
+
+	// A body that can't be rewound isn't resent
+	httpClient = &recordingHTTPClient{}
+	req, err = http.NewRequestWithContext(context.Background(), http.MethodPost, "https://iam",
+		ioutil.NopCloser(strings.NewReader("payload")))
+	require.NoError(t, err)
+	_, err = DoRequestWithRetries(context.Background(), httpClient, req, policy) // nolint: bodyclose
+	assert.EqualError(t, err, "request body can't be rewound for retry")
+	assert.Equal(t, []string{"payload"}, httpClient.bodies)
+}
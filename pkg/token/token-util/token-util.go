@@ -7,10 +7,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/errors"
 	"gopkg.in/square/go-jose.v2"
@@ -38,23 +36,28 @@ type HttpClient interface {
 }
 
 // DecodeAccessToken decodes the accessToken offline
+// The errors returned are one of errors.ErrMalformedJWT, errors.ErrBadPayload, errors.ErrBadClaims
+// or errors.ErrMissingExpiry
 func DecodeAccessToken(rawToken string) (Token, error) {
-	_, err := jose.ParseSigned(rawToken)
-	if err != nil {
-		return Token{}, fmt.Errorf("oidc: malformed jwt: %v", err)
-	}
-
 	// Throw out tokens with invalid claims before trying to verify the token. This lets
 	// us do cheap checks before possibly re-syncing keys.
 	payload, err := parseJWT(rawToken)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("oidc: malformed jwt: %v", err))
-		return Token{}, fmt.Errorf("oidc: malformed jwt: %v", err)
+		return Token{}, err
+	}
+
+	_, err = jose.ParseSigned(rawToken)
+	if err != nil {
+		return Token{}, errors.MakeErrMalformedJWT(err)
 	}
+
 	var token Token
 	if err := json.Unmarshal(payload, &token); err != nil {
-		log.Fatal(fmt.Sprintf("oidc: failed to unmarshal claims: %v", err))
-		return Token{}, fmt.Errorf("oidc: failed to unmarshal claims: %v", err)
+		return Token{}, errors.MakeErrBadClaims(err)
+	}
+
+	if token.Expiry == 0 {
+		return Token{}, errors.MakeErrMissingExpiry()
 	}
 
 	if token.UserID != "" {
@@ -70,27 +73,6 @@ func DecodeAccessToken(rawToken string) (Token, error) {
 	return token, nil
 }
 
-func DoRetries(call func() (*http.Response, error), retries int) (*http.Response, error) {
-	var resp *http.Response
-	var err error
-
-	for {
-		resp, err = call()
-		if err != nil {
-			return nil, err
-		}
-
-		if !isStatusRetryable(resp.StatusCode) || retries == 0 {
-			break
-		}
-
-		time.Sleep(3 * time.Second)
-		retries--
-	}
-
-	return resp, nil
-}
-
 func ManageHTTPErrorCodes(resp *http.Response, clientID string) error {
 	var err error
 
@@ -103,6 +85,12 @@ func ManageHTTPErrorCodes(resp *http.Response, clientID string) error {
 			return err
 		}
 		msg := fmt.Sprintf("Bad request: %v", string(body))
+		if isInvalidGrant(body) {
+			return errors.MakeErrInvalidGrant(errors.ErrorResponse{
+				ErrorCode: "ErrGenerateTokenInvalidGrant",
+				Message:   msg,
+			})
+		}
 		err = errors.MakeErrBadRequest(errors.ErrorResponse{
 			ErrorCode: "ErrGenerateTokenBadRequest",
 			Message:   msg,
@@ -128,22 +116,23 @@ func ManageHTTPErrorCodes(resp *http.Response, clientID string) error {
 	}
 }
 
-func isStatusRetryable(statusCode int) bool {
-	if statusCode == http.StatusInternalServerError || statusCode == http.StatusTooManyRequests {
-		return true
+// isInvalidGrant checks if the body of a response is an OAuth2 error response with the invalid_grant error
+func isInvalidGrant(body []byte) bool {
+	var oauthErr struct {
+		Error string `json:"error"`
 	}
 
-	return false
+	return json.Unmarshal(body, &oauthErr) == nil && oauthErr.Error == "invalid_grant"
 }
 
 func parseJWT(p string) ([]byte, error) {
 	parts := strings.Split(p, ".")
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("oidc: malformed jwt, expected 3 parts got %d", len(parts))
+	if len(parts) != 3 {
+		return nil, errors.MakeErrMalformedJWT(fmt.Errorf("expected 3 parts got %d", len(parts)))
 	}
 	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return nil, fmt.Errorf("oidc: malformed jwt payload: %v", err)
+		return nil, errors.MakeErrBadPayload(err)
 	}
 	return payload, nil
 }
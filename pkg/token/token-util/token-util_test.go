@@ -3,12 +3,14 @@
 package tokenutil
 
 import (
-	"errors"
-	"net/http"
+	stderrors "errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/errors"
 )
 
 func TestDecodeAccessToken(t *testing.T) {
@@ -128,70 +130,67 @@ func TestDecodeAccessToken(t *testing.T) {
 	}
 }
 
-// nolint: tparallel
-func TestDoRetries(t *testing.T) {
+func signTestPayload(t *testing.T, payload string) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: []byte("secret")}, nil)
+	require.NoError(t, err)
+	jws, err := signer.Sign([]byte(payload))
+	require.NoError(t, err)
+	token, err := jws.CompactSerialize()
+	require.NoError(t, err)
+
+	return token
+}
+
+func TestDecodeAccessTokenErrors(t *testing.T) {
 	t.Parallel()
-	totalRetries := 0
 	testcases := []struct {
-		name           string
-		call           func() (*http.Response, error)
-		responseStatus int
-		err            error
+		name     string
+		rawToken string
+		check    func(err error) bool
+		msg      string
 	}{
 		{
-			name: "status 500",
-			call: func() (*http.Response, error) {
-				totalRetries++
-
-				return &http.Response{StatusCode: http.StatusInternalServerError}, nil
-			},
-			responseStatus: http.StatusInternalServerError,
+			name:     "empty token",
+			rawToken: "",
+			check:    func(err error) bool { var e *errors.ErrMalformedJWT; return stderrors.As(err, &e) },
+			msg:      "oidc: malformed jwt: expected 3 parts got 1",
 		},
 		{
-			name: "status 429",
-			call: func() (*http.Response, error) {
-				totalRetries++
-
-				return &http.Response{StatusCode: http.StatusTooManyRequests}, nil
-			},
-			responseStatus: http.StatusTooManyRequests,
+			name:     "bad base64 payload",
+			rawToken: "eyJhbGciOiJIUzI1NiJ9.!!!.c2ln",
+			check:    func(err error) bool { var e *errors.ErrBadPayload; return stderrors.As(err, &e) },
+			msg:      "oidc: malformed jwt payload: illegal base64 data at input byte 0",
 		},
 		{
-			name: "status 502 no retry",
-			call: func() (*http.Response, error) {
-				totalRetries++
-
-				return &http.Response{StatusCode: http.StatusBadGateway}, nil
-			},
-			responseStatus: http.StatusBadGateway,
+			name:     "bad header",
+			rawToken: "bm90anNvbg.e30.c2ln",
+			check:    func(err error) bool { var e *errors.ErrMalformedJWT; return stderrors.As(err, &e) },
+			msg:      "oidc: malformed jwt: invalid character 'o' in literal null (expecting 'u')",
 		},
 		{
-			name: "no url",
-			call: func() (*http.Response, error) {
-				return nil, errors.New("http: nil Request.URL")
-			},
-			err: errors.New("http: nil Request.URL"),
+			name:     "bad claims",
+			rawToken: signTestPayload(t, `{"exp":"tomorrow"}`),
+			check:    func(err error) bool { var e *errors.ErrBadClaims; return stderrors.As(err, &e) },
+			msg: "oidc: failed to unmarshal claims: json: cannot unmarshal string into Go struct field " +
+				"Token.exp of type int64",
+		},
+		{
+			name:     "missing exp",
+			rawToken: signTestPayload(t, `{"sub":"subject"}`),
+			check:    func(err error) bool { var e *errors.ErrMissingExpiry; return stderrors.As(err, &e) },
+			msg:      "oidc: jwt has no exp claim",
 		},
 	}
 
 	for _, testcase := range testcases {
 		tc := testcase
 		t.Run(tc.name, func(t *testing.T) {
-			resp, err := DoRetries(tc.call, 1) // nolint: bodyclose
-			if tc.err != nil {
-				assert.EqualError(t, err, tc.err.Error())
-			} else {
-				assert.Equal(t, tc.responseStatus, resp.StatusCode)
-
-				// only 429 and 500 status codes should retry
-				if tc.responseStatus == http.StatusBadGateway {
-					assert.Equal(t, 1, totalRetries)
-				} else {
-					assert.Equal(t, 2, totalRetries)
-				}
-
-				totalRetries = 0
-			}
+			t.Parallel()
+			_, err := DecodeAccessToken(tc.rawToken)
+			require.Error(t, err)
+			assert.True(t, tc.check(err), "unexpected error type %T", err)
+			assert.EqualError(t, err, tc.msg)
 		})
 	}
 }
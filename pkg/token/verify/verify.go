@@ -0,0 +1,326 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/internal/flight"
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/errors"
+	tokenutil "github.com/hewlettpackard/hpegl-provider-lib/pkg/token/token-util"
+)
+
+const (
+	// DefaultClockSkew is the tolerance allowed when checking the exp, nbf and iat claims
+	DefaultClockSkew = time.Minute
+
+	// defaultCacheTTL is how long keys fetched from the issuer are cached for
+	defaultCacheTTL = time.Hour
+
+	// minRefreshInterval rate-limits the refetching of keys when a token is signed with an unknown key
+	minRefreshInterval = time.Minute
+
+	discoveryPath = "/.well-known/openid-configuration"
+)
+
+// discoveryDocument the fields of the OIDC discovery document that are used
+type discoveryDocument struct {
+	Issuer  string `json:"issuer"`
+	JWKSURI string `json:"jwks_uri"`
+}
+
+// Verifier verifies the signature and claims of tokens using the issuer's JWKS.  The JWKS is found
+// using OIDC discovery and is cached, or is read from a local file.
+type Verifier struct {
+	issuerURL  string
+	audience   string
+	clockSkew  time.Duration
+	cacheTTL   time.Duration
+	jwksFile   string
+	httpClient tokenutil.HttpClient
+
+	// mu guards the cached keys, the issuer discovered and the fetch in progress.  The fetch is shared by every
+	// caller that needs new keys, so that concurrent callers result in a single fetch and callers with cached
+	// keys aren't blocked by it.
+	mu        sync.Mutex
+	keys      *jose.JSONWebKeySet
+	issuer    string
+	fetchedAt time.Time
+	fetch     *flight.Flight
+}
+
+// Opt - function option definition
+type Opt func(v *Verifier)
+
+// WithAudience sets the audience that tokens must have been issued for
+func WithAudience(audience string) Opt {
+	return func(v *Verifier) {
+		v.audience = audience
+	}
+}
+
+// WithClockSkew override DefaultClockSkew
+func WithClockSkew(skew time.Duration) Opt {
+	return func(v *Verifier) {
+		v.clockSkew = skew
+	}
+}
+
+// WithJWKSFile read the JWKS from a local file rather than from the issuer, for air-gapped testing
+func WithJWKSFile(path string) Opt {
+	return func(v *Verifier) {
+		v.jwksFile = path
+	}
+}
+
+// WithHTTPClient override the http client used to fetch the JWKS
+func WithHTTPClient(c tokenutil.HttpClient) Opt {
+	return func(v *Verifier) {
+		v.httpClient = c
+	}
+}
+
+// New creates a Verifier for tokens issued by issuerURL.  If the JWKS is fetched from the issuer then
+// tokens must have the issuer given in the discovery document, otherwise they must have issuerURL.
+func New(issuerURL string, opts ...Opt) (*Verifier, error) {
+	v := &Verifier{
+		issuerURL:  strings.TrimRight(issuerURL, "/"),
+		clockSkew:  DefaultClockSkew,
+		cacheTTL:   defaultCacheTTL,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+
+	// run overrides
+	for _, opt := range opts {
+		if opt != nil {
+			opt(v)
+		}
+	}
+
+	if v.jwksFile != "" {
+		keys, err := readJWKSFile(v.jwksFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+		v.issuer = v.issuerURL
+	}
+
+	return v, nil
+}
+
+// Verify checks the signature of rawToken against the issuer's keys, and validates its iss, aud, exp,
+// nbf and iat claims allowing for clock skew.  The decoded token is returned if it is valid, otherwise
+// an errors.ErrTokenVerification is returned.
+func (v *Verifier) Verify(ctx context.Context, rawToken string) (tokenutil.Token, error) {
+	tok, err := jwt.ParseSigned(rawToken)
+	if err != nil {
+		return tokenutil.Token{}, errors.MakeErrMalformedJWT(err)
+	}
+
+	if len(tok.Headers) != 1 {
+		return tokenutil.Token{}, errors.MakeErrTokenVerification(fmt.Errorf("expected 1 signature got %d", len(tok.Headers)))
+	}
+	kid := tok.Headers[0].KeyID
+
+	keys, issuer, err := v.getKeys(ctx, kid)
+	if err != nil {
+		return tokenutil.Token{}, errors.MakeErrTokenVerification(err)
+	}
+
+	claims, err := verifySignature(tok, keys, kid)
+	if err != nil {
+		return tokenutil.Token{}, errors.MakeErrTokenVerification(err)
+	}
+
+	if claims.Expiry == nil {
+		return tokenutil.Token{}, errors.MakeErrMissingExpiry()
+	}
+
+	expected := jwt.Expected{
+		Issuer: issuer,
+		Time:   time.Now(),
+	}
+	if v.audience != "" {
+		expected.Audience = jwt.Audience{v.audience}
+	}
+
+	if err = claims.ValidateWithLeeway(expected, v.clockSkew); err != nil {
+		return tokenutil.Token{}, errors.MakeErrTokenVerification(err)
+	}
+
+	return tokenutil.DecodeAccessToken(rawToken)
+}
+
+// verifySignature verifies the signature of tok with the key identified by kid, or with each key in
+// turn if the token doesn't identify its key
+func verifySignature(tok *jwt.JSONWebToken, keys *jose.JSONWebKeySet, kid string) (jwt.Claims, error) {
+	var claims jwt.Claims
+
+	candidates := keys.Keys
+	if kid != "" {
+		candidates = keys.Key(kid)
+	}
+
+	if len(candidates) == 0 {
+		return claims, fmt.Errorf("no key found with kid %q", kid)
+	}
+
+	var err error
+	for _, key := range candidates {
+		if err = tok.Claims(key.Public(), &claims); err == nil {
+			return claims, nil
+		}
+	}
+
+	return claims, err
+}
+
+// getKeys returns the cached keys and the expected issuer, fetching the keys if they haven't been
+// fetched, if the cache has expired, or if kid isn't in the cache.  The keys are fetched without v.mu
+// held, so that callers that can use the cached keys aren't blocked by the fetch.
+func (v *Verifier) getKeys(ctx context.Context, kid string) (*jose.JSONWebKeySet, string, error) {
+	v.mu.Lock()
+
+	// Keys read from a file are never refetched
+	if v.jwksFile != "" {
+		defer v.mu.Unlock()
+
+		return v.keys, v.issuer, nil
+	}
+
+	now := time.Now()
+	stale := v.keys == nil || now.Sub(v.fetchedAt) > v.cacheTTL
+	unknownKey := v.keys != nil && kid != "" && len(v.keys.Key(kid)) == 0 && now.Sub(v.fetchedAt) > minRefreshInterval
+
+	if !stale && !unknownKey {
+		defer v.mu.Unlock()
+
+		return v.keys, v.issuer, nil
+	}
+
+	f := v.fetch
+	if f == nil {
+		f = v.startFetch()
+	}
+	f.Join()
+	v.mu.Unlock()
+
+	_, err := f.Wait(ctx, func() {
+		if v.fetch == f {
+			v.fetch = nil
+		}
+	})
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// Fall back to the cached keys if the fetch failed and we have them, unless the caller gave up
+	if err != nil && (v.keys == nil || err == ctx.Err()) {
+		return nil, "", err
+	}
+
+	return v.keys, v.issuer, nil
+}
+
+// startFetch starts fetching the keys, it must be called with v.mu held
+func (v *Verifier) startFetch() *flight.Flight {
+	var issuer string
+	var keys *jose.JSONWebKeySet
+
+	ctx, cancel := context.WithCancel(context.Background())
+	v.fetch = flight.Start(ctx, cancel, &v.mu,
+		func(ctx context.Context) (interface{}, error) {
+			var err error
+			issuer, keys, err = v.fetchKeys(ctx)
+
+			return nil, err
+		},
+		func(f *flight.Flight, _ interface{}, err error) (interface{}, error) {
+			if v.fetch == f {
+				v.fetch = nil
+			}
+
+			if err == nil {
+				v.issuer, v.keys, v.fetchedAt = issuer, keys, time.Now()
+			}
+
+			return nil, err
+		})
+
+	return v.fetch
+}
+
+// fetchKeys uses OIDC discovery to find and fetch the issuer's JWKS
+func (v *Verifier) fetchKeys(ctx context.Context) (string, *jose.JSONWebKeySet, error) {
+	var doc discoveryDocument
+	if err := v.getJSON(ctx, v.issuerURL+discoveryPath, &doc); err != nil {
+		return "", nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	if doc.JWKSURI == "" {
+		return "", nil, fmt.Errorf("oidc discovery: no jwks_uri in discovery document from %s", v.issuerURL)
+	}
+
+	issuer := doc.Issuer
+	if issuer == "" {
+		issuer = v.issuerURL
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	if err := v.getJSON(ctx, doc.JWKSURI, keys); err != nil {
+		return "", nil, fmt.Errorf("fetching jwks: %w", err)
+	}
+
+	return issuer, keys, nil
+}
+
+func (v *Verifier) getJSON(ctx context.Context, url string, dest interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := tokenutil.DoRequestWithRetries(ctx, v.httpClient, req, tokenutil.DefaultRetryPolicy())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d from %s", resp.StatusCode, url)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, dest)
+}
+
+func readJWKSFile(path string) (*jose.JSONWebKeySet, error) {
+	b, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	keys := &jose.JSONWebKeySet{}
+	if err = json.Unmarshal(b, keys); err != nil {
+		return nil, fmt.Errorf("parsing jwks file %s: %w", path, err)
+	}
+
+	return keys, nil
+}
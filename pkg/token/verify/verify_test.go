@@ -0,0 +1,364 @@
+// (C) Copyright 2021 Hewlett Packard Enterprise Development LP
+
+package verify
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	stderrors "errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+
+	"github.com/hewlettpackard/hpegl-provider-lib/pkg/token/errors"
+)
+
+const testAudience = "test-client"
+
+// testIssuer is a fake OIDC issuer that serves a discovery document and a JWKS
+type testIssuer struct {
+	server     *httptest.Server
+	jwksServed int32
+
+	mu   sync.Mutex
+	keys []jose.JSONWebKey
+	// block, if set, holds up serving the JWKS until it is closed
+	block chan struct{}
+}
+
+func newTestIssuer(t *testing.T, keys ...jose.JSONWebKey) *testIssuer {
+	t.Helper()
+	ti := &testIssuer{keys: keys}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(discoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(discoveryDocument{
+			Issuer:  ti.server.URL,
+			JWKSURI: ti.server.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ti.jwksServed, 1)
+		ti.mu.Lock()
+		block := ti.block
+		ti.mu.Unlock()
+		if block != nil {
+			<-block
+		}
+
+		ti.mu.Lock()
+		defer ti.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(publicKeySet(ti.keys...))
+	})
+
+	ti.server = httptest.NewServer(mux)
+	t.Cleanup(ti.server.Close)
+
+	return ti
+}
+
+func (ti *testIssuer) setKeys(keys ...jose.JSONWebKey) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.keys = keys
+}
+
+func newTestKey(t *testing.T, kid string) jose.JSONWebKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	return jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.RS256), Use: "sig"}
+}
+
+func publicKeySet(keys ...jose.JSONWebKey) jose.JSONWebKeySet {
+	set := jose.JSONWebKeySet{}
+	for _, k := range keys {
+		set.Keys = append(set.Keys, k.Public())
+	}
+
+	return set
+}
+
+func signTestToken(t *testing.T, key jose.JSONWebKey, claims jwt.Claims) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", key.KeyID))
+	require.NoError(t, err)
+
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	require.NoError(t, err)
+
+	return token
+}
+
+func validClaims(issuer string) jwt.Claims {
+	now := time.Now()
+
+	return jwt.Claims{
+		Issuer:    issuer,
+		Audience:  jwt.Audience{testAudience},
+		Expiry:    jwt.NewNumericDate(now.Add(time.Hour)),
+		NotBefore: jwt.NewNumericDate(now.Add(-time.Minute)),
+		IssuedAt:  jwt.NewNumericDate(now.Add(-time.Minute)),
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+	key := newTestKey(t, "key-1")
+	otherKey := newTestKey(t, "key-1")
+	issuer := newTestIssuer(t, key)
+
+	testcases := []struct {
+		name    string
+		key     jose.JSONWebKey
+		claims  func(c *jwt.Claims)
+		wantErr bool
+	}{
+		{
+			name:   "valid token",
+			key:    key,
+			claims: func(c *jwt.Claims) {},
+		},
+		{
+			name:    "signed by another key",
+			key:     otherKey,
+			claims:  func(c *jwt.Claims) {},
+			wantErr: true,
+		},
+		{
+			name:    "wrong issuer",
+			key:     key,
+			claims:  func(c *jwt.Claims) { c.Issuer = "https://evil.example.com" },
+			wantErr: true,
+		},
+		{
+			name:    "wrong audience",
+			key:     key,
+			claims:  func(c *jwt.Claims) { c.Audience = jwt.Audience{"another-client"} },
+			wantErr: true,
+		},
+		{
+			name:    "expired",
+			key:     key,
+			claims:  func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(time.Now().Add(-2 * DefaultClockSkew)) },
+			wantErr: true,
+		},
+		{
+			name:   "expired within clock skew",
+			key:    key,
+			claims: func(c *jwt.Claims) { c.Expiry = jwt.NewNumericDate(time.Now().Add(-DefaultClockSkew / 2)) },
+		},
+		{
+			name:    "not yet valid",
+			key:     key,
+			claims:  func(c *jwt.Claims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(2 * DefaultClockSkew)) },
+			wantErr: true,
+		},
+		{
+			name:   "not yet valid within clock skew",
+			key:    key,
+			claims: func(c *jwt.Claims) { c.NotBefore = jwt.NewNumericDate(time.Now().Add(DefaultClockSkew / 2)) },
+		},
+		{
+			name:    "no expiry",
+			key:     key,
+			claims:  func(c *jwt.Claims) { c.Expiry = nil },
+			wantErr: true,
+		},
+	}
+
+	for _, testcase := range testcases {
+		tc := testcase
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			v, err := New(issuer.server.URL, WithAudience(testAudience))
+			require.NoError(t, err)
+
+			claims := validClaims(issuer.server.URL)
+			tc.claims(&claims)
+			rawToken := signTestToken(t, tc.key, claims)
+
+			token, err := v.Verify(context.Background(), rawToken)
+			if tc.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, claims.Expiry.Time().Unix(), token.Expiry)
+		})
+	}
+}
+
+func TestVerifyErrorType(t *testing.T) {
+	t.Parallel()
+	key := newTestKey(t, "key-1")
+	issuer := newTestIssuer(t, key)
+
+	v, err := New(issuer.server.URL)
+	require.NoError(t, err)
+
+	claims := validClaims("https://evil.example.com")
+	_, err = v.Verify(context.Background(), signTestToken(t, key, claims))
+
+	var verr *errors.ErrTokenVerification
+	require.True(t, stderrors.As(err, &verr))
+	assert.True(t, stderrors.Is(err, jwt.ErrInvalidIssuer))
+}
+
+func TestVerifyCachesKeys(t *testing.T) {
+	t.Parallel()
+	key := newTestKey(t, "key-1")
+	issuer := newTestIssuer(t, key)
+
+	v, err := New(issuer.server.URL)
+	require.NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = v.Verify(context.Background(), signTestToken(t, key, validClaims(issuer.server.URL)))
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&issuer.jwksServed))
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	t.Parallel()
+	oldKey := newTestKey(t, "key-1")
+	newKey := newTestKey(t, "key-2")
+	issuer := newTestIssuer(t, oldKey)
+
+	v, err := New(issuer.server.URL)
+	require.NoError(t, err)
+
+	_, err = v.Verify(context.Background(), signTestToken(t, oldKey, validClaims(issuer.server.URL)))
+	require.NoError(t, err)
+
+	issuer.setKeys(newKey)
+	newToken := signTestToken(t, newKey, validClaims(issuer.server.URL))
+
+	// The keys were fetched too recently to be refetched for an unknown kid
+	_, err = v.Verify(context.Background(), newToken)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&issuer.jwksServed))
+
+	v.mu.Lock()
+	v.fetchedAt = v.fetchedAt.Add(-2 * minRefreshInterval)
+	v.mu.Unlock()
+
+	_, err = v.Verify(context.Background(), newToken)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&issuer.jwksServed))
+}
+
+func TestVerifyFetchDoesNotBlockCachedKeys(t *testing.T) {
+	t.Parallel()
+	oldKey := newTestKey(t, "key-1")
+	newKey := newTestKey(t, "key-2")
+	issuer := newTestIssuer(t, oldKey)
+
+	v, err := New(issuer.server.URL)
+	require.NoError(t, err)
+
+	oldToken := signTestToken(t, oldKey, validClaims(issuer.server.URL))
+	_, err = v.Verify(context.Background(), oldToken)
+	require.NoError(t, err)
+
+	block := make(chan struct{})
+	issuer.mu.Lock()
+	issuer.keys = []jose.JSONWebKey{oldKey, newKey}
+	issuer.block = block
+	issuer.mu.Unlock()
+	v.mu.Lock()
+	v.fetchedAt = v.fetchedAt.Add(-2 * minRefreshInterval)
+	v.mu.Unlock()
+
+	// A token signed with the new key starts a fetch that is held up by the issuer
+	newToken := signTestToken(t, newKey, validClaims(issuer.server.URL))
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := v.Verify(context.Background(), newToken)
+		errCh <- err
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&issuer.jwksServed) == 2 }, 5*time.Second,
+		10*time.Millisecond)
+
+	// Tokens signed with a cached key are verified while the fetch is in progress
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = v.Verify(ctx, oldToken)
+	assert.NoError(t, err)
+
+	// Callers waiting on the fetch can give up
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = v.Verify(ctx, newToken)
+	assert.True(t, stderrors.Is(err, context.DeadlineExceeded))
+
+	close(block)
+	assert.NoError(t, <-errCh)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&issuer.jwksServed))
+}
+
+func TestVerifyJWKSFile(t *testing.T) {
+	t.Parallel()
+	const issuerURL = "https://iam.example.com"
+	key := newTestKey(t, "key-1")
+
+	b, err := json.Marshal(publicKeySet(key))
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, ioutil.WriteFile(path, b, 0600))
+
+	v, err := New(issuerURL, WithJWKSFile(path), WithAudience(testAudience))
+	require.NoError(t, err)
+
+	_, err = v.Verify(context.Background(), signTestToken(t, key, validClaims(issuerURL)))
+	assert.NoError(t, err)
+
+	_, err = v.Verify(context.Background(), signTestToken(t, key, validClaims("https://evil.example.com")))
+	assert.Error(t, err)
+}
+
+func TestNewJWKSFileErrors(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	badFile := filepath.Join(dir, "bad.json")
+	require.NoError(t, ioutil.WriteFile(badFile, []byte("not json"), 0600))
+
+	_, err := New("https://iam.example.com", WithJWKSFile(filepath.Join(dir, "missing.json")))
+	assert.Error(t, err)
+
+	_, err = New("https://iam.example.com", WithJWKSFile(badFile))
+	assert.Error(t, err)
+}
+
+func TestVerifyDiscoveryFailure(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	v, err := New(server.URL)
+	require.NoError(t, err)
+
+	key := newTestKey(t, "key-1")
+	_, err = v.Verify(context.Background(), signTestToken(t, key, validClaims(server.URL)))
+
+	var verr *errors.ErrTokenVerification
+	assert.True(t, stderrors.As(err, &verr))
+}